@@ -1,6 +1,6 @@
 module github.com/t94j0/satellite
 
-go 1.12
+go 1.17
 
 require (
 	github.com/fsnotify/fsnotify v1.4.7
@@ -8,14 +8,31 @@ require (
 	github.com/imdario/mergo v0.3.7
 	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/oschwald/geoip2-golang v1.3.0
-	github.com/oschwald/maxminddb-golang v1.4.0 // indirect
 	github.com/pkg/errors v0.8.1
 	github.com/prologic/bitcask v0.3.4
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/viper v1.4.0
 	github.com/t94j0/array v0.0.0-20180426153242-68930562a6bd
+	go.starlark.net v0.0.0-20230302034142-4b1e35fe2254
 	golang.org/x/crypto v0.0.0-20191117063200-497ca9f6d64f
 	golang.org/x/net v0.0.0-20191119073136-fc4aabc6c914
-	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150 // indirect
+	golang.org/x/sys v0.7.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require (
+	github.com/gofrs/flock v0.7.1 // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/magiconair/properties v1.8.1 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/oschwald/maxminddb-golang v1.4.0 // indirect
+	github.com/pelletier/go-toml v1.4.0 // indirect
+	github.com/plar/go-adaptive-radix-tree v1.0.1 // indirect
+	github.com/spf13/afero v1.2.2 // indirect
+	github.com/spf13/cast v1.3.0 // indirect
+	github.com/spf13/jwalterweatherman v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56 // indirect
+	golang.org/x/text v0.3.2 // indirect
+)
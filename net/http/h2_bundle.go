@@ -4277,6 +4277,13 @@ type http2serverConn struct {
 	shutdownTimer               *time.Timer // nil until used
 	idleTimer                   *time.Timer // nil if unused
 
+	// Frames seen before the first HEADERS frame, for the Akamai
+	// HTTP/2 fingerprint. Also owned by the serve loop.
+	fpSettings     []http2Setting
+	fpWindowUpdate uint32
+	fpPriorities   []string
+	fpPrefix       string // set once the first HEADERS frame arrives
+
 	// Owned by the writeFrameAsync goroutine:
 	headerWriteBuf bytes.Buffer
 	hpackEncoder   *hpack.Encoder
@@ -5206,6 +5213,9 @@ func (sc *http2serverConn) processWindowUpdate(f *http2WindowUpdateFrame) error
 		if !sc.flow.add(int32(f.Increment)) {
 			return http2goAwayFlowError{}
 		}
+		if sc.fpPrefix == "" && sc.fpWindowUpdate == 0 {
+			sc.fpWindowUpdate = f.Increment
+		}
 	}
 	sc.scheduleFrameWrite()
 	return nil
@@ -5286,6 +5296,12 @@ func (sc *http2serverConn) processSettings(f *http2SettingsFrame) error {
 	if err := f.ForeachSetting(sc.processSetting); err != nil {
 		return err
 	}
+	if sc.fpPrefix == "" {
+		f.ForeachSetting(func(s http2Setting) error {
+			sc.fpSettings = append(sc.fpSettings, s)
+			return nil
+		})
+	}
 	sc.needToSendSettingsAck = true
 	sc.scheduleFrameWrite()
 	return nil
@@ -5661,10 +5677,50 @@ func (sc *http2serverConn) processPriority(f *http2PriorityFrame) error {
 	if err := http2checkPriority(f.StreamID, f.http2PriorityParam); err != nil {
 		return err
 	}
+	if sc.fpPrefix == "" {
+		exclusive := 0
+		if f.Exclusive {
+			exclusive = 1
+		}
+		sc.fpPriorities = append(sc.fpPriorities, fmt.Sprintf("%d:%d:%d:%d",
+			f.StreamID, exclusive, f.StreamDep, int(f.Weight)+1))
+	}
 	sc.writeSched.AdjustStream(f.StreamID, f.http2PriorityParam)
 	return nil
 }
 
+// fingerprint returns the Akamai-style fingerprint of the connection,
+// SETTINGS|WINDOW_UPDATE|PRIORITY|pseudo-header order, using the
+// pseudo-header order of f. The connection-level part is frozen when the
+// first HEADERS frame is seen.
+// See https://www.blackhat.com/docs/eu-17/materials/eu-17-Shuster-Passive-Fingerprinting-Of-HTTP2-Clients-wp.pdf
+func (sc *http2serverConn) fingerprint(f *http2MetaHeadersFrame) string {
+	sc.serveG.check()
+	if sc.fpPrefix == "" {
+		settings := make([]string, 0, len(sc.fpSettings))
+		for _, s := range sc.fpSettings {
+			settings = append(settings, fmt.Sprintf("%d:%d", s.ID, s.Val))
+		}
+		windowUpdate := "00"
+		if sc.fpWindowUpdate != 0 {
+			windowUpdate = strconv.FormatUint(uint64(sc.fpWindowUpdate), 10)
+		}
+		priorities := "0"
+		if len(sc.fpPriorities) > 0 {
+			priorities = strings.Join(sc.fpPriorities, ",")
+		}
+		sc.fpPrefix = strings.Join(settings, ";") + "|" + windowUpdate + "|" + priorities
+		sc.fpSettings = nil
+		sc.fpPriorities = nil
+	}
+
+	pseudo := make([]string, 0, 4)
+	for _, hf := range f.PseudoFields() {
+		pseudo = append(pseudo, hf.Name[1:2])
+	}
+	return sc.fpPrefix + "|" + strings.Join(pseudo, ",")
+}
+
 func (sc *http2serverConn) newStream(id, pusherID uint32, state http2streamState) *http2stream {
 	sc.serveG.check()
 	if id == 0 {
@@ -5738,8 +5794,10 @@ func (sc *http2serverConn) newWriterAndRequest(st *http2stream, f *http2MetaHead
 	}
 
 	rp.header = make(Header)
+	var headerOrder []string
 	for _, hf := range f.RegularFields() {
 		rp.header.Add(sc.canonicalHeader(hf.Name), hf.Value)
+		headerOrder = append(headerOrder, hf.Name)
 	}
 	if rp.authority == "" {
 		rp.authority = rp.header.Get("Host")
@@ -5749,6 +5807,9 @@ func (sc *http2serverConn) newWriterAndRequest(st *http2stream, f *http2MetaHead
 	if err != nil {
 		return nil, nil, err
 	}
+	req.HTTP2Fingerprint = sc.fingerprint(f)
+	req.headerOrder = headerOrder
+	req.JA4HFingerprint = req.ja4h()
 	if bodyOpen {
 		if vv, ok := rp.header["Content-Length"]; ok {
 			req.ContentLength, _ = strconv.ParseInt(vv[0], 10, 64)
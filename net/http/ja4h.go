@@ -0,0 +1,82 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ja4h returns the JA4H fingerprint of r, as described at
+// https://github.com/FoxIO-LLC/ja4. It relies on r.headerOrder, so it is
+// only meaningful for requests read by the Server.
+func (r *Request) ja4h() string {
+	method := strings.ToLower(r.Method)
+	if len(method) > 2 {
+		method = method[:2]
+	}
+
+	var headers []string
+	for _, name := range r.headerOrder {
+		switch strings.ToLower(name) {
+		case "cookie", "referer":
+			continue
+		}
+		headers = append(headers, name)
+	}
+
+	cookie := "n"
+	if len(r.Header["Cookie"]) > 0 {
+		cookie = "c"
+	}
+	referer := "n"
+	if len(r.Header["Referer"]) > 0 {
+		referer = "r"
+	}
+	headerCount := len(headers)
+	if headerCount > 99 {
+		headerCount = 99
+	}
+
+	lang := strings.ToLower(r.Header.get("Accept-Language"))
+	lang = strings.Replace(lang, "-", "", -1)
+	if i := strings.IndexAny(lang, ",;"); i >= 0 {
+		lang = lang[:i]
+	}
+	if len(lang) > 4 {
+		lang = lang[:4]
+	}
+	lang += strings.Repeat("0", 4-len(lang))
+
+	var names, fields []string
+	for _, line := range r.Header["Cookie"] {
+		for _, field := range strings.Split(line, ";") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			name := field
+			if i := strings.Index(field, "="); i >= 0 {
+				name = field[:i]
+			}
+			names = append(names, name)
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(fields)
+
+	return fmt.Sprintf("%s%d%d%s%s%02d%s_%s_%s_%s", method, r.ProtoMajor, r.ProtoMinor,
+		cookie, referer, headerCount, lang, ja4hHash(headers), ja4hHash(names), ja4hHash(fields))
+}
+
+// ja4hHash returns the first 12 hex characters of the SHA-256 of the comma
+// separated values, or zeros if there are none.
+func ja4hHash(values []string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(strings.Join(values, ",")))
+	return hex.EncodeToString(sum[:])[:12]
+}
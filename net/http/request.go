@@ -26,6 +26,7 @@ import (
 	"strings"
 	"sync"
 
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/idna"
 )
 
@@ -318,7 +319,29 @@ type Request struct {
 	// and mutating the contexts held by callers of the same request.
 	ctx context.Context
 
+	// JA3Fingerprint is the JA3 string of the TLS ClientHello the
+	// request arrived on. It is empty for requests not received over TLS.
 	JA3Fingerprint string
+
+	// HTTP2Fingerprint is the Akamai-style fingerprint of the HTTP/2
+	// connection the request arrived on, in the form
+	// SETTINGS|WINDOW_UPDATE|PRIORITY|pseudo-header order, for example
+	// "1:65536;4:131072;5:16384|12517377|3:0:0:201|m,p,a,s".
+	// It is empty for HTTP/1.x requests.
+	HTTP2Fingerprint string
+
+	// JA4Fingerprint is the JA4 fingerprint of the TLS ClientHello the
+	// request arrived on. It is empty for requests not received over TLS.
+	JA4Fingerprint string
+
+	// JA4HFingerprint is the JA4H fingerprint of the request, computed
+	// from its method, version, header order and cookies. It is only set
+	// by the Server.
+	JA4HFingerprint string
+
+	// headerOrder is the header field names in the order they were
+	// received, as sent by the client. It is only set by the Server.
+	headerOrder []string
 }
 
 // Context returns the request's context. To change the context, use
@@ -1004,11 +1027,12 @@ func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err erro
 	}
 
 	// Subsequent lines: Key: value.
-	mimeHeader, err := tp.ReadMIMEHeader()
+	mimeHeader, order, err := readHeader(tp)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = Header(mimeHeader)
+	req.headerOrder = order
 
 	// RFC 7230, section 5.3: Must treat
 	//	GET /index.html HTTP/1.1
@@ -1047,6 +1071,77 @@ func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err erro
 	return req, nil
 }
 
+// maxHeaderFields is the maximum number of header fields readHeader accepts.
+const maxHeaderFields = 1000
+
+// readHeader reads the header block with textproto.Reader.ReadMIMEHeader and
+// also returns the header field names in the order they were received, which
+// JA4H needs and the map loses.
+//
+// Field names must be valid tokens, so "Transfer-Encoding : chunked" is
+// rejected rather than trimmed, and field values must not contain control
+// characters.
+func readHeader(r *textproto.Reader) (textproto.MIMEHeader, []string, error) {
+	// Read the raw header block up to the blank line, so the field names
+	// can be recorded before ReadMIMEHeader folds them into a map.
+	var raw bytes.Buffer
+	fields := 0
+	for {
+		line, err := r.R.ReadBytes('\n')
+		raw.Write(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			fields++
+			if fields > maxHeaderFields {
+				return nil, nil, textproto.ProtocolError("too many header fields")
+			}
+		}
+	}
+
+	block := raw.Bytes()
+	m, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+	if err != nil {
+		return m, nil, err
+	}
+
+	order := headerOrder(block)
+	for _, name := range order {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return m, nil, textproto.ProtocolError("malformed MIME header key: " + name)
+		}
+	}
+	for key, values := range m {
+		for _, v := range values {
+			if !httpguts.ValidHeaderFieldValue(v) {
+				return m, nil, textproto.ProtocolError("malformed MIME header value for " + key)
+			}
+		}
+	}
+	return m, order, nil
+}
+
+// headerOrder returns the field names of a header block in the order they
+// appear.
+func headerOrder(raw []byte) []string {
+	var order []string
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 || line[0] == ' ' || line[0] == '\t' {
+			// Continuation lines belong to the previous field.
+			continue
+		}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			order = append(order, string(line[:i]))
+		}
+	}
+	return order
+}
+
 // MaxBytesReader is similar to io.LimitReader but is intended for
 // limiting the size of incoming request bodies. In contrast to
 // io.LimitReader, MaxBytesReader's result is a ReadCloser, returns a
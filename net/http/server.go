@@ -1776,6 +1776,7 @@ func (c *conn) serve(ctx context.Context) {
 		return
 	}
 	JA3Fingerprint := tlsConn.JA3Fingerprint
+	JA4Fingerprint := tlsConn.JA4Fingerprint
 
 	// HTTP/1.x from here on.
 
@@ -1848,6 +1849,8 @@ func (c *conn) serve(ctx context.Context) {
 		// But we're not going to implement HTTP pipelining because it
 		// was never deployed in the wild and the answer is HTTP/2.
 		w.req.JA3Fingerprint = JA3Fingerprint
+		w.req.JA4Fingerprint = JA4Fingerprint
+		w.req.JA4HFingerprint = w.req.ja4h()
 		serverHandler{c.server}.ServeHTTP(w, w.req)
 		w.cancelCtx()
 		if c.hijacked() {
@@ -3292,6 +3295,12 @@ func (h initNPNRequest) ServeHTTP(rw ResponseWriter, req *Request) {
 	if req.RemoteAddr == "" {
 		req.RemoteAddr = h.c.RemoteAddr().String()
 	}
+	if req.JA3Fingerprint == "" {
+		req.JA3Fingerprint = h.c.JA3Fingerprint
+	}
+	if req.JA4Fingerprint == "" {
+		req.JA4Fingerprint = h.c.JA4Fingerprint
+	}
 	h.h.ServeHTTP(rw, req)
 }
 
@@ -15,6 +15,8 @@ func Config() (*viper.Viper, error) {
 
 	config.SetDefault("server_root", "/var/www/html")
 	config.SetDefault("listen", "127.0.0.1:8080")
+	config.SetDefault("rdns.timeout", "2s")
+	config.SetDefault("rdns.cache_ttl", "10m")
 
 	config.SetConfigName("config")
 	config.AddConfigPath("$HOME/.config/" + ProjectName)
@@ -1,15 +1,18 @@
 package geoip
 
 import (
+	"math"
 	"net"
 	"os"
+	"strings"
 
 	gip "github.com/oschwald/geoip2-golang"
 )
 
 // DB holds the DB reader
 type DB struct {
-	db *gip.Reader
+	db  *gip.Reader
+	asn *gip.Reader
 }
 
 // New creates a new DB reader based on the mmdb path
@@ -27,11 +30,50 @@ func New(dbpath string) (DB, error) {
 	return geoip, nil
 }
 
+// OpenASN opens an ASN mmdb, such as GeoLite2-ASN, alongside the country DB
+func (g *DB) OpenASN(dbpath string) error {
+	if _, err := os.Stat(dbpath); os.IsNotExist(err) {
+		return os.ErrNotExist
+	}
+
+	db, err := gip.Open(dbpath)
+	if err != nil {
+		return err
+	}
+	g.asn = db
+	return nil
+}
+
+// HasASN returns true when the ASN DB was configured properly
+func (g DB) HasASN() bool {
+	return g.asn != nil
+}
+
+// ASN returns the autonomous system number and organization of the target IP
+func (g DB) ASN(ip net.IP) (uint, string, error) {
+	a, err := g.asn.ASN(ip)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return a.AutonomousSystemNumber, a.AutonomousSystemOrganization, nil
+}
+
 // HasDB returns true when the DB was configured properly
 func (g DB) HasDB() bool {
 	return g.db != nil
 }
 
+// HasCity returns true when the DB has city level data, such as regions,
+// cities, coordinates and time zones. Country databases don't
+func (g DB) HasCity() bool {
+	if g.db == nil {
+		return false
+	}
+	dbType := g.db.Metadata().DatabaseType
+	return strings.Contains(dbType, "City") || dbType == "GeoIP2-Enterprise"
+}
+
 // CountryCode returns the ISO country code of the target IP
 func (g DB) CountryCode(ip net.IP) (string, error) {
 	c, err := g.db.Country(ip)
@@ -41,3 +83,69 @@ func (g DB) CountryCode(ip net.IP) (string, error) {
 
 	return c.Country.IsoCode, nil
 }
+
+// TimeZone returns the IANA time zone of the target IP, such as Europe/Berlin. It requires a City database
+func (g DB) TimeZone(ip net.IP) (string, error) {
+	c, err := g.db.City(ip)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Location.TimeZone, nil
+}
+
+// earthRadiusKM is the mean radius of the earth
+const earthRadiusKM = 6371.0
+
+// Location is the city level location of an IP
+type Location struct {
+	// CountryCode is the ISO country code
+	CountryCode string
+	// Subdivisions are ISO 3166-2 region codes, such as US-CA, from the largest to the smallest
+	Subdivisions []string
+	// City is the English name of the city
+	City string
+	// Latitude and Longitude are the approximate coordinates of the IP
+	Latitude  float64
+	Longitude float64
+	// AccuracyRadius is the radius in kilometers around the coordinates the IP is likely to be in
+	AccuracyRadius uint16
+}
+
+// Location returns the city level location of the target IP. It requires a City database
+func (g DB) Location(ip net.IP) (Location, error) {
+	c, err := g.db.City(ip)
+	if err != nil {
+		return Location{}, err
+	}
+
+	loc := Location{
+		CountryCode:    c.Country.IsoCode,
+		City:           c.City.Names["en"],
+		Latitude:       c.Location.Latitude,
+		Longitude:      c.Location.Longitude,
+		AccuracyRadius: c.Location.AccuracyRadius,
+	}
+	for _, s := range c.Subdivisions {
+		if s.IsoCode != "" {
+			loc.Subdivisions = append(loc.Subdivisions, c.Country.IsoCode+"-"+s.IsoCode)
+		}
+	}
+	return loc, nil
+}
+
+// HasCoordinates returns true when the database knew where the IP is
+func (l Location) HasCoordinates() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+// DistanceKM returns the great-circle distance in kilometers from the location to the coordinates
+func (l Location) DistanceKM(latitude, longitude float64) float64 {
+	lat1 := l.Latitude * math.Pi / 180
+	lat2 := latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (longitude - l.Longitude) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Sqrt(a))
+}
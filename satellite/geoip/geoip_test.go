@@ -3,12 +3,14 @@ package geoip_test
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
 
 	. "github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/geoip/geoiptest"
 )
 
 func createGeoIP() (DB, error) {
@@ -56,3 +58,175 @@ func TestNew_CountryCode(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func createASN(t *testing.T) DB {
+	dir, err := ioutil.TempDir("", "satellitegeoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	if err := geoiptest.WriteDB(fp, "GeoLite2-ASN", []geoiptest.Network{
+		{CIDR: "8.8.8.0/24", Record: map[string]interface{}{
+			"autonomous_system_number":       uint32(15169),
+			"autonomous_system_organization": "Google LLC",
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var gip DB
+	if err := gip.OpenASN(fp); err != nil {
+		t.Fatal(err)
+	}
+	return gip
+}
+
+func TestDB_ASN(t *testing.T) {
+	gip := createASN(t)
+	if !gip.HasASN() || gip.HasDB() {
+		t.Fail()
+	}
+
+	asn, org, err := gip.ASN(net.ParseIP("8.8.8.8"))
+	if err != nil {
+		t.Error(err)
+	}
+	if asn != 15169 || org != "Google LLC" {
+		t.Errorf("got AS%d %s", asn, org)
+	}
+}
+
+func TestDB_ASN_none(t *testing.T) {
+	gip := createASN(t)
+	asn, org, err := gip.ASN(net.ParseIP("1.1.1.1"))
+	if err != nil {
+		t.Error(err)
+	}
+	if asn != 0 || org != "" {
+		t.Fail()
+	}
+}
+
+func TestDB_OpenASN_badpath(t *testing.T) {
+	var gip DB
+	if err := gip.OpenASN("/this-path-should-not-exist"); err == nil {
+		t.Fail()
+	}
+}
+
+// cityNetworks are the fixture records of the City database
+var cityNetworks = []geoiptest.Network{
+	{CIDR: "203.0.113.0/24", Record: map[string]interface{}{
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Berlin"}},
+		"country": map[string]interface{}{"iso_code": "DE"},
+		"location": map[string]interface{}{
+			"latitude":        52.52,
+			"longitude":       13.405,
+			"accuracy_radius": uint16(20),
+			"time_zone":       "Europe/Berlin",
+		},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "BE"},
+		},
+	}},
+	{CIDR: "198.51.100.0/24", Record: map[string]interface{}{
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "San Francisco"}},
+		"country": map[string]interface{}{"iso_code": "US"},
+		"location": map[string]interface{}{
+			"latitude":        37.7749,
+			"longitude":       -122.4194,
+			"accuracy_radius": uint16(5),
+			"time_zone":       "America/Los_Angeles",
+		},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "CA"},
+		},
+	}},
+}
+
+func createCity(t *testing.T) DB {
+	dir, err := ioutil.TempDir("", "satellitegeoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "GeoLite2-City.mmdb")
+	if err := geoiptest.WriteDB(fp, "GeoLite2-City", cityNetworks); err != nil {
+		t.Fatal(err)
+	}
+
+	gip, err := New(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gip
+}
+
+func TestDB_Location(t *testing.T) {
+	gip := createCity(t)
+	loc, err := gip.Location(net.ParseIP("203.0.113.9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.CountryCode != "DE" || loc.City != "Berlin" || len(loc.Subdivisions) != 1 || loc.Subdivisions[0] != "DE-BE" {
+		t.Errorf("unexpected location %+v", loc)
+	}
+	if loc.Latitude != 52.52 || loc.Longitude != 13.405 || loc.AccuracyRadius != 20 {
+		t.Errorf("unexpected coordinates %+v", loc)
+	}
+}
+
+func TestDB_Location_unknown(t *testing.T) {
+	gip := createCity(t)
+	loc, err := gip.Location(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.HasCoordinates() || loc.City != "" {
+		t.Fail()
+	}
+}
+
+func TestDB_CountryCode_city(t *testing.T) {
+	gip := createCity(t)
+	cc, err := gip.CountryCode(net.ParseIP("198.51.100.1"))
+	if err != nil || cc != "US" {
+		t.Fail()
+	}
+}
+
+func TestDB_HasCity(t *testing.T) {
+	if !createCity(t).HasCity() {
+		t.Fail()
+	}
+}
+
+func TestDB_HasCity_country(t *testing.T) {
+	gip, err := createGeoIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gip.HasCity() {
+		t.Fail()
+	}
+}
+
+func TestDB_TimeZone(t *testing.T) {
+	gip := createCity(t)
+	tz, err := gip.TimeZone(net.ParseIP("198.51.100.1"))
+	if err != nil || tz != "America/Los_Angeles" {
+		t.Fail()
+	}
+}
+
+func TestLocation_DistanceKM(t *testing.T) {
+	berlin := Location{Latitude: 52.52, Longitude: 13.405}
+	// Paris is about 878km from Berlin
+	if d := berlin.DistanceKM(48.8566, 2.3522); d < 870 || d > 885 {
+		t.Errorf("distance to Paris was %f", d)
+	}
+	if d := berlin.DistanceKM(52.52, 13.405); d != 0 {
+		t.Errorf("distance to itself was %f", d)
+	}
+}
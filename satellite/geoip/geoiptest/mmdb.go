@@ -0,0 +1,214 @@
+// Package geoiptest writes small MaxMind DB files for tests
+package geoiptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// metadataMarker starts the metadata section of a MaxMind DB
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Network is an IPv4 network and the record stored for it. Records are maps
+// of strings, unsigned integers, floats, slices and nested maps
+type Network struct {
+	CIDR   string
+	Record map[string]interface{}
+}
+
+// record is a search tree record: a node, some data or nothing
+type record struct {
+	node int
+	data int
+	set  bool
+	leaf bool
+}
+
+// WriteDB writes an IPv4 MaxMind DB of databaseType, such as GeoLite2-ASN or
+// GeoLite2-City, to path
+func WriteDB(path, databaseType string, networks []Network) error {
+	data, err := Build(databaseType, networks)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Build encodes an IPv4 MaxMind DB of databaseType
+func Build(databaseType string, networks []Network) ([]byte, error) {
+	nodes := [][2]record{{}}
+	var dataSection bytes.Buffer
+
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil {
+			return nil, errors.New("only IPv4 networks are supported")
+		}
+		ones, _ := ipNet.Mask.Size()
+		if ones == 0 {
+			return nil, errors.New("networks need a prefix")
+		}
+
+		offset := dataSection.Len()
+		if err := encode(&dataSection, n.Record); err != nil {
+			return nil, err
+		}
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = record{data: offset, set: true, leaf: true}
+				break
+			}
+			r := nodes[node][bit]
+			if r.leaf {
+				return nil, errors.New("networks may not overlap")
+			}
+			if !r.set {
+				nodes = append(nodes, [2]record{})
+				r = record{node: len(nodes) - 1, set: true}
+				nodes[node][bit] = r
+			}
+			node = r.node
+		}
+	}
+
+	nodeCount := len(nodes)
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for _, r := range n {
+			value := nodeCount
+			if r.set && r.leaf {
+				value = nodeCount + 16 + r.data
+			} else if r.set {
+				value = r.node
+			}
+			out.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(dataSection.Bytes())
+	out.Write(metadataMarker)
+
+	metadata := map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               databaseType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"description":                 map[string]interface{}{"en": "satellite test database"},
+	}
+	if err := encode(&out, metadata); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// encode writes a value in the MaxMind DB data section format
+func encode(w *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		writeControl(w, 2, len(v))
+		w.WriteString(v)
+	case float64:
+		writeControl(w, 3, 8)
+		binary.Write(w, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		writeUint(w, 5, uint64(v))
+	case uint32:
+		writeUint(w, 6, uint64(v))
+	case uint:
+		writeUint(w, 6, uint64(v))
+	case int:
+		writeUint(w, 6, uint64(v))
+	case uint64:
+		writeUint(w, 9, v)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		writeControl(w, 14, size)
+	case []interface{}:
+		writeControl(w, 11, len(v))
+		for _, e := range v {
+			if err := encode(w, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeControl(w, 7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := encode(w, k); err != nil {
+				return err
+			}
+			if err := encode(w, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+func writeUint(w *bytes.Buffer, typeNum int, v uint64) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	writeControl(w, typeNum, len(b))
+	w.Write(b)
+}
+
+func writeControl(w *bytes.Buffer, typeNum, size int) {
+	var control byte
+	var extended []byte
+	if typeNum <= 7 {
+		control = byte(typeNum << 5)
+	} else {
+		extended = []byte{byte(typeNum - 7)}
+	}
+
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		control |= byte(size)
+	case size < 285:
+		control |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 65821:
+		control |= 30
+		size -= 285
+		sizeBytes = []byte{byte(size >> 8), byte(size)}
+	default:
+		control |= 31
+		size -= 65821
+		sizeBytes = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+	}
+
+	w.WriteByte(control)
+	w.Write(extended)
+	w.Write(sizeBytes)
+}
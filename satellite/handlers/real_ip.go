@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// RealIPHandler rewrites the RemoteAddr of requests coming through trusted
+// proxies to the client address they forwarded, so that every condition and
+// the request log see the real client
+type RealIPHandler struct {
+	next    http.Handler
+	proxies util.TrustedProxies
+}
+
+// NewRealIPHandler creates a new RealIPHandler object
+func NewRealIPHandler(next http.Handler, proxies util.TrustedProxies) RealIPHandler {
+	return RealIPHandler{
+		next:    next,
+		proxies: proxies,
+	}
+}
+
+// ServeHTTP resolves the client address and passes the request on
+func (h RealIPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.proxies.Enabled() {
+		if ip := h.proxies.ClientIP(req); ip != nil && !ip.Equal(util.GetHost(req)) {
+			_, port, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				port = "0"
+			}
+			log.WithFields(log.Fields{
+				"peer_addr": req.RemoteAddr,
+				"client_ip": ip.String(),
+			}).Debug("Resolved client IP through trusted proxy")
+			req.RemoteAddr = net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	h.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,97 @@
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	. "github.com/t94j0/satellite/satellite/handlers"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+func resolveRemoteAddr(t *testing.T, trusted []string, trustedHeader, remoteAddr string, header http.Header) string {
+	proxies, err := util.NewTrustedProxies(trusted, trustedHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resolved string
+	handler := NewRealIPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resolved = req.RemoteAddr
+	}), proxies)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header = header
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	return resolved
+}
+
+func TestRealIPHandler_xff_trusted(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": {"203.0.113.7, 10.0.0.2"}}
+	if addr := resolveRemoteAddr(t, []string{"10.0.0.0/8"}, "", "10.0.0.1:4444", header); addr != "203.0.113.7:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestRealIPHandler_xff_untrusted(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+	if addr := resolveRemoteAddr(t, []string{"10.0.0.0/8"}, "", "198.51.100.1:4444", header); addr != "198.51.100.1:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestRealIPHandler_xff_spoofed(t *testing.T) {
+	// The client prepended its own X-Forwarded-For, only the hop added by the proxy counts
+	header := http.Header{"X-Forwarded-For": {"127.0.0.1, 203.0.113.7"}}
+	if addr := resolveRemoteAddr(t, []string{"10.0.0.1"}, "", "10.0.0.1:4444", header); addr != "203.0.113.7:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestRealIPHandler_forwarded_ipv6(t *testing.T) {
+	header := http.Header{
+		"Forwarded":       {`for="[2001:db8::7]:4711";proto=https`},
+		"X-Forwarded-For": {"203.0.113.7"},
+	}
+	if addr := resolveRemoteAddr(t, []string{"2001:db8:ffff::/48"}, "Forwarded", "[2001:db8:ffff::1]:4444", header); addr != "[2001:db8::7]:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestRealIPHandler_no_proxies(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+	if addr := resolveRemoteAddr(t, nil, "", "10.0.0.1:4444", header); addr != "10.0.0.1:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestNewTrustedProxies_fail(t *testing.T) {
+	if _, err := util.NewTrustedProxies([]string{"10.0.0/8"}, ""); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRealIPHandler_forwarded_ignored(t *testing.T) {
+	// The proxy only appends X-Forwarded-For, so a Forwarded header came from the client
+	header := http.Header{
+		"Forwarded":       {"for=1.2.3.4"},
+		"X-Forwarded-For": {"203.0.113.7"},
+	}
+	if addr := resolveRemoteAddr(t, []string{"10.0.0.0/8"}, "", "10.0.0.1:4444", header); addr != "203.0.113.7:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestRealIPHandler_xff_ignored(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": {"1.2.3.4"}}
+	if addr := resolveRemoteAddr(t, []string{"10.0.0.0/8"}, "Forwarded", "10.0.0.1:4444", header); addr != "10.0.0.1:4444" {
+		t.Error(addr)
+	}
+}
+
+func TestNewTrustedProxies_bad_header(t *testing.T) {
+	if _, err := util.NewTrustedProxies([]string{"10.0.0.0/8"}, "X-Real-IP"); err == nil {
+		t.Fail()
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/hex"
 	"io"
 	"net"
-	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/t94j0/satellite/net/http"
@@ -46,16 +45,16 @@ func (h RootHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("Server", h.serverHeader)
 	}
 
-	served, err := h.paths.MatchAndServe(w, req)
+	served, score, err := h.paths.MatchAndServeScore(w, req)
 	if err != nil {
 		log.Error(err)
 	}
 	if !served {
 		log.Debug("File not found. Redirecting to not_found")
-		h.log(req, 301)
+		h.log(req, 301, score)
 		h.notExistHandler(w, req)
 	} else {
-		h.log(req, 200)
+		h.log(req, 200, score)
 	}
 }
 
@@ -80,13 +79,7 @@ func getJA3(req *http.Request) string {
 	return string(out)
 }
 
-func parseRemoteAddr(ipPort string) net.IP {
-	targetIP := strings.Split(ipPort, ":")[0]
-	return net.ParseIP(targetIP)
-}
-
-func getCountryCode(remoteAddr string, gip *geoip.DB) (string, error) {
-	targetHost := parseRemoteAddr(remoteAddr)
+func getCountryCode(targetHost net.IP, gip *geoip.DB) (string, error) {
 	if gip.HasDB() {
 		cc, err := gip.CountryCode(targetHost)
 		if err != nil {
@@ -97,20 +90,49 @@ func getCountryCode(remoteAddr string, gip *geoip.DB) (string, error) {
 	return "", nil
 }
 
-func (h RootHandler) log(req *http.Request, respCode int) {
+func getASN(targetHost net.IP, gip *geoip.DB) (uint, string, error) {
+	if gip.HasASN() {
+		return gip.ASN(targetHost)
+	}
+	return 0, "", nil
+}
+
+func getSNI(req *http.Request) string {
+	if req.TLS == nil {
+		return ""
+	}
+	return req.TLS.ServerName
+}
+
+func (h RootHandler) log(req *http.Request, respCode int, score *path.Score) {
 	ja3 := getJA3(req)
-	cc, err := getCountryCode(req.RemoteAddr, &h.paths.GeoipDB)
+	cc, err := getCountryCode(util.GetHost(req), &h.paths.GeoipDB)
+	if err != nil {
+		log.Error(err)
+	}
+	asn, org, err := getASN(util.GetHost(req), &h.paths.GeoipDB)
 	if err != nil {
 		log.Error(err)
 	}
-	log.WithFields(log.Fields{
+	fields := log.Fields{
 		"method":      req.Method,
 		"host":        req.Host,
+		"sni":         getSNI(req),
 		"remote_addr": req.RemoteAddr,
 		"req_uri":     req.RequestURI,
 		"ja3":         ja3,
+		"ja4":         req.JA4Fingerprint,
+		"ja4h":        req.JA4HFingerprint,
+		"h2":          req.HTTP2Fingerprint,
 		"response":    respCode,
 		"user_agent":  req.UserAgent(),
 		"geo_ip":      cc,
-	}).Info("request")
+		"asn":         asn,
+		"asn_org":     org,
+	}
+	if score != nil {
+		fields["score"] = score.Total
+		fields["score_breakdown"] = score.String()
+	}
+	log.WithFields(fields).Info("request")
 }
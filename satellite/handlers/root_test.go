@@ -1,12 +1,16 @@
 package handlers_test
 
 import (
+	stls "crypto/tls"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/t94j0/satellite/crypto/tls"
+	shttp "github.com/t94j0/satellite/net/http"
 	"github.com/t94j0/satellite/net/http/httptest"
 	. "github.com/t94j0/satellite/satellite/handlers"
 	"github.com/t94j0/satellite/satellite/path"
@@ -193,3 +197,102 @@ func TestRootHandler_ServeHTTP_notfound_404(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRootHandler_ServeHTTP_h2(t *testing.T) {
+	td, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer td.Close()
+	// d41d8cd98f00b204e9800998ecf8427e is the JA3 hash of an empty fingerprint
+	td.CreateFiles(map[string]string{
+		"/index.html": "Hello!",
+		"pathList.yml": `- path: /index.html
+  hosted_file: /index.html
+  not:
+    - authorized_ja3:
+        - d41d8cd98f00b204e9800998ecf8427e`,
+	})
+	paths, err := td.Paths()
+	if err != nil {
+		t.Error(err)
+	}
+	handler := NewRootHandler(paths, NoNotFound, "/index.html", "Server")
+
+	var h2Fingerprint string
+	ts := httptest.NewUnstartedServer(shttp.HandlerFunc(func(w shttp.ResponseWriter, req *shttp.Request) {
+		h2Fingerprint = req.HTTP2Fingerprint
+		handler.ServeHTTP(w, req)
+	}))
+	ts.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &stls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(ts.URL + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || string(body) != "Hello!" {
+		t.Fail()
+	}
+	// The Go client sends all four pseudo-headers, in its own order
+	if parts := strings.Split(h2Fingerprint, "|"); len(parts) != 4 || len(strings.Split(parts[3], ",")) != 4 {
+		t.Errorf("unexpected HTTP/2 fingerprint %q", h2Fingerprint)
+	}
+}
+
+func TestRootHandler_ServeHTTP_ja4(t *testing.T) {
+	td, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer td.Close()
+	td.CreateFiles(map[string]string{
+		"/index.html": "Hello!",
+		"pathList.yml": `- path: /index.html
+  hosted_file: /index.html`,
+	})
+	paths, err := td.Paths()
+	if err != nil {
+		t.Error(err)
+	}
+	handler := NewRootHandler(paths, NoNotFound, "/index.html", "Server")
+
+	var ja4, ja4h string
+	ts := httptest.NewUnstartedServer(shttp.HandlerFunc(func(w shttp.ResponseWriter, req *shttp.Request) {
+		ja4, ja4h = req.JA4Fingerprint, req.JA4HFingerprint
+		handler.ServeHTTP(w, req)
+	}))
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &stls.Config{InsecureSkipVerify: true},
+	}}
+	req, err := http.NewRequest("GET", ts.URL+"/index.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !strings.HasPrefix(ja4, "t13i") || len(strings.Split(ja4, "_")) != 3 {
+		t.Errorf("unexpected JA4 fingerprint %q", ja4)
+	}
+	// Host, User-Agent, Accept-Language and Accept-Encoding are counted, Cookie is not
+	if parts := strings.Split(ja4h, "_"); len(parts) != 4 || parts[0] != "ge11cn04enus" {
+		t.Errorf("unexpected JA4H fingerprint %q", ja4h)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"path"
 
 	log "github.com/sirupsen/logrus"
@@ -26,6 +27,7 @@ func main() {
 	listen := config.GetString("listen")
 	certPath := config.GetString("ssl.cert")
 	keyPath := config.GetString("ssl.key")
+	clientCAPath := config.GetString("ssl.client_ca")
 	serverHeader := config.GetString("server_header")
 	notFoundRedirect := config.GetString("not_found.redirect")
 	notFoundRender := config.GetString("not_found.render")
@@ -33,6 +35,21 @@ func main() {
 	redirectHTTP := config.GetBool("redirect_http")
 	logLevel := config.GetString("log_level")
 	geoipPath := config.GetString("geoip_path")
+	asnPath := config.GetString("asn_path")
+	trustedProxies := config.GetStringSlice("trusted_proxies")
+	trustedProxyHeader := config.GetString("trusted_proxy_header")
+	proxyProtocol := config.GetBool("proxy_protocol")
+	rdnsResolver := config.GetString("rdns.resolver")
+	rdnsTimeout := config.GetDuration("rdns.timeout")
+	rdnsCacheTTL := config.GetDuration("rdns.cache_ttl")
+	signingKey := config.GetString("signed_url.key")
+
+	if len(os.Args) > 1 && os.Args[1] == "mint" {
+		if err := mint(os.Args[2:], signingKey, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	logOptions := map[string]log.Level{
 		"":      log.DebugLevel,
@@ -60,6 +77,31 @@ func main() {
 	if err := paths.AddGeoIP(geoipPath); err != nil {
 		log.Warn("Unable to access geoip_path. Geo to IP functionality disabled.")
 	}
+	if asnPath != "" {
+		if err := paths.AddASN(asnPath); err != nil {
+			log.Warn("Unable to access asn_path. ASN functionality disabled.")
+		}
+	}
+
+	if clientCAPath != "" {
+		if err := paths.AddClientCA(clientCAPath); err != nil {
+			log.Fatal(errors.Wrap(err, "ssl.client_ca configuration error"))
+		}
+	}
+
+	if signingKey != "" {
+		paths.AddSigningKey(signingKey)
+	}
+	paths.AddRDNS(rdnsResolver, rdnsTimeout, rdnsCacheTTL)
+
+	proxies, err := util.NewTrustedProxies(trustedProxies, trustedProxyHeader)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "trusted_proxies configuration error"))
+	}
+	// Proxies trusted by header terminate TLS, while PROXY protocol passes it through
+	if err := paths.SetTLSOffloaded(proxies.Enabled() && !proxyProtocol); err != nil {
+		log.Fatal(err)
+	}
 
 	log.Debugf("Loaded %d path(s)", paths.Len())
 
@@ -82,7 +124,7 @@ func main() {
 	}
 
 	// Build SSL Key object
-	ssl, err := server.NewSSL(keyPath, certPath)
+	ssl, err := server.NewSSL(keyPath, certPath, clientCAPath)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -97,6 +139,8 @@ func main() {
 		serverHeader,
 		indexPath,
 		redirectHTTP,
+		proxies,
+		proxyProtocol,
 	)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "server configuration error"))
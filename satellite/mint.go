@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	sPath "github.com/t94j0/satellite/satellite/path"
+)
+
+// mint prints a signed URL for a hosted file, signed with signed_url.key
+//
+//	satellite mint -file /payload.exe -ttl 48h -ip 203.0.113.7 -uses 1 -prefix /d/
+func mint(args []string, key string, out io.Writer) error {
+	flags := flag.NewFlagSet("mint", flag.ContinueOnError)
+	file := flags.String("file", "", "hosted file served for the token, relative to server_root")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the token is valid for")
+	ip := flags.String("ip", "", "only allow this client IP to use the token")
+	uses := flags.Uint64("uses", 1, "how many times the token can be used, or 0 for unlimited")
+	prefix := flags.String("prefix", "/d/", "path of the signed_url entry in the path list, without the glob")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("mint needs -file")
+	}
+	var bind net.IP
+	if *ip != "" {
+		if bind = net.ParseIP(*ip); bind == nil {
+			return errors.New(fmt.Sprintf("%s is not a valid IP", *ip))
+		}
+	}
+
+	token, err := sPath.MintToken([]byte(key), *file, *ttl, bind, *uses)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, path.Join("/", *prefix, token))
+	return err
+}
@@ -0,0 +1,244 @@
+package path
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth restricts a path to operators. A request is authenticated when any
+// of the configured methods accepts it. Failed requests are handled like any
+// other failed condition, so no challenge is sent
+type Auth struct {
+	// Htpasswd is an htpasswd file of bcrypt hashes for Basic auth
+	Htpasswd string `yaml:"htpasswd,omitempty"`
+	// Bearer are the tokens accepted in an Authorization: Bearer header
+	Bearer []string `yaml:"bearer,omitempty"`
+	// ClientCert accepts mutual TLS client certificates. It needs ssl.client_ca
+	// in config.yml, so that the server asks clients for certificates. The
+	// handshake accepts any certificate and the chain is verified here
+	ClientCert *ClientCertAuth `yaml:"client_cert,omitempty"`
+
+	once  sync.Once
+	err   error
+	users map[string][]byte
+	roots *x509.CertPool
+}
+
+// ClientCertAuth accepts client certificates
+type ClientCertAuth struct {
+	// CA is a PEM bundle the certificate must chain to. When empty, the
+	// certificate must chain to ssl.client_ca
+	CA string `yaml:"ca,omitempty"`
+	// Subjects are globs matched against the common name and the DNS, email
+	// and URI SANs of the certificate. Any certificate is accepted when empty
+	Subjects []string `yaml:"subjects,omitempty"`
+}
+
+// Load reads the htpasswd file and CA bundle and compiles the subject globs
+func (a *Auth) Load() error {
+	a.once.Do(func() { a.err = a.load() })
+	return a.err
+}
+
+func (a *Auth) load() error {
+	if a.Htpasswd != "" {
+		users, err := readHtpasswd(a.Htpasswd)
+		if err != nil {
+			return err
+		}
+		a.users = users
+	}
+
+	if a.ClientCert == nil {
+		return nil
+	}
+	for _, s := range a.ClientCert.Subjects {
+		if _, err := glob.Compile(s); err != nil {
+			return errors.New(fmt.Sprintf("%s is not valid glob", s))
+		}
+	}
+	if a.ClientCert.CA != "" {
+		roots, err := readCertPool(a.ClientCert.CA)
+		if err != nil {
+			return err
+		}
+		a.roots = roots
+	}
+	return nil
+}
+
+// readCertPool reads a PEM bundle of CAs
+func readCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("%s has no PEM certificates", path))
+	}
+	return pool, nil
+}
+
+// AddClientCA adds the CAs client certificates must chain to on paths with
+// client_cert auth and no CA of their own
+func (paths *Paths) AddClientCA(path string) error {
+	roots, err := readCertPool(path)
+	if err != nil {
+		return err
+	}
+	paths.state.clientCAs = roots
+	return nil
+}
+
+// readHtpasswd reads the users of an htpasswd file. Only bcrypt hashes are
+// supported, since the others are too weak to put in front of a payload
+func readHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i < 1 {
+			return nil, errors.New(fmt.Sprintf("%s:%d is not a valid htpasswd line", path, line))
+		}
+		hash := []byte(text[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d is not a bcrypt hash", path, line)
+		}
+		users[text[:i]] = hash
+	}
+	return users, scanner.Err()
+}
+
+// Authenticate checks if the request is from an operator. clientCAs verify
+// client certificates when the path has no CA of its own
+func (a *Auth) Authenticate(req *http.Request, clientCAs *x509.CertPool) bool {
+	if err := a.Load(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to load auth")
+		return false
+	}
+
+	if method, ok := a.authenticate(req, clientCAs); ok {
+		log.WithFields(log.Fields{
+			"auth": method,
+		}).Debug("Authenticated")
+		return true
+	}
+	log.Debug("Not authenticated")
+	return false
+}
+
+func (a *Auth) authenticate(req *http.Request, clientCAs *x509.CertPool) (string, bool) {
+	if a.users != nil {
+		if user, password, ok := req.BasicAuth(); ok {
+			if hash, found := a.users[user]; found && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+				return "basic", true
+			}
+		}
+	}
+
+	if len(a.Bearer) != 0 {
+		if token := bearerToken(req); token != "" {
+			for _, b := range a.Bearer {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(b)) == 1 {
+					return "bearer", true
+				}
+			}
+		}
+	}
+
+	if a.ClientCert != nil && a.clientCert(req, clientCAs) {
+		return "client_cert", true
+	}
+
+	return "", false
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+func (a *Auth) clientCert(req *http.Request, clientCAs *x509.CertPool) bool {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	leaf := req.TLS.PeerCertificates[0]
+
+	roots := a.roots
+	if roots == nil {
+		roots = clientCAs
+	}
+	if roots == nil {
+		log.Debug("No CA to verify the client certificate")
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		log.WithFields(log.Fields{
+			"subject": leaf.Subject.String(),
+			"error":   err,
+		}).Debug("Client certificate did not verify")
+		return false
+	}
+
+	if len(a.ClientCert.Subjects) == 0 {
+		return true
+	}
+	names := []string{leaf.Subject.CommonName}
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, u := range leaf.URIs {
+		names = append(names, u.String())
+	}
+	for _, s := range a.ClientCert.Subjects {
+		g := glob.MustCompile(s)
+		for _, name := range names {
+			if name != "" && g.Match(name) {
+				return true
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"subject": leaf.Subject.String(),
+	}).Debug("Client certificate subject did not match")
+	return false
+}
@@ -0,0 +1,264 @@
+package path_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/crypto/tls"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	. "github.com/t94j0/satellite/satellite/path"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authPaths serves /index.html behind auth, redirecting failures to /miss.
+// HTPASSWD in auth is replaced by an htpasswd file for operator:hunter2
+func authPaths(t *testing.T, auth ...string) (*Paths, TempDir) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	serverRoot.CreateIndexFile()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Error(err)
+	}
+	serverRoot.CreateFile(".htpasswd", "# operators\noperator:"+string(hash)+"\n")
+
+	htpasswd := filepath.Join(serverRoot.Path, ".htpasswd")
+	content := []string{"on_failure:", "  redirect: /miss", "auth:"}
+	for _, line := range auth {
+		content = append(content, strings.Replace(line, "HTPASSWD", htpasswd, -1))
+	}
+	serverRoot.CreatePathListIndex(content...)
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+	return paths, serverRoot
+}
+
+func authRequest(t *testing.T, paths *Paths, req *http.Request) bool {
+	w := httptest.NewRecorder()
+	served, err := paths.MatchAndServe(w, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if !served {
+		t.Error("request was not handled")
+	}
+	return w.Code == 200 && w.Body.String() == Sentinal
+}
+
+func TestPaths_MatchAndServe_auth_basic(t *testing.T) {
+	paths, serverRoot := authPaths(t, "  htpasswd: HTPASSWD")
+	defer serverRoot.Close()
+
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	req.SetBasicAuth("operator", "hunter2")
+	if !authRequest(t, paths, req) {
+		t.Error("operator was not served")
+	}
+
+	req = httptest.NewRequest("GET", "/index.html", nil)
+	req.SetBasicAuth("operator", "wrong")
+	if authRequest(t, paths, req) {
+		t.Error("wrong password was served")
+	}
+
+	req = httptest.NewRequest("GET", "/index.html", nil)
+	if authRequest(t, paths, req) {
+		t.Error("anonymous request was served")
+	}
+}
+
+func TestNewDefault_auth_htpasswd_md5(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateFile(".htpasswd", "operator:$apr1$lZL6V/ci$eIMz/iKDkbtys/uU7LEK00\n")
+	serverRoot.CreatePathListIndex("auth:", "  htpasswd: "+filepath.Join(serverRoot.Path, ".htpasswd"))
+
+	if _, err := NewDefaultTest(serverRoot.Path); err == nil {
+		t.Fail()
+	}
+}
+
+func TestPaths_MatchAndServe_auth_bearer(t *testing.T) {
+	paths, serverRoot := authPaths(t, "  bearer: [s3cret, other]")
+	defer serverRoot.Close()
+
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if !authRequest(t, paths, req) {
+		t.Error("token was not served")
+	}
+
+	req = httptest.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("Authorization", "Bearer s3cre")
+	if authRequest(t, paths, req) {
+		t.Error("wrong token was served")
+	}
+}
+
+// newCert creates a certificate for cn signed by parent, or self-signed when parent is nil
+func newCert(t *testing.T, cn string, dnsNames []string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeCA writes cert as a PEM bundle in dir
+func writeCA(t *testing.T, dir, name string, cert *x509.Certificate) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func clientCertRequest(cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	return req
+}
+
+func TestPaths_MatchAndServe_auth_client_cert(t *testing.T) {
+	ca, caKey := newCert(t, "operators", nil, nil, nil)
+	operator, _ := newCert(t, "alice", []string{"alice.ops.example"}, ca, caKey)
+	stranger, _ := newCert(t, "mallory", []string{"mallory.example"}, ca, caKey)
+	otherCA, otherKey := newCert(t, "other", nil, nil, nil)
+	forged, _ := newCert(t, "alice", []string{"alice.ops.example"}, otherCA, otherKey)
+
+	caDir, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer caDir.Close()
+	caFile := filepath.Join(caDir.Path, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, serverRoot := authPaths(t, "  client_cert:", "    ca: "+caFile, "    subjects: ['*.ops.example']")
+	defer serverRoot.Close()
+
+	if !authRequest(t, paths, clientCertRequest(operator)) {
+		t.Error("operator was not served")
+	}
+	if authRequest(t, paths, clientCertRequest(stranger)) {
+		t.Error("other subject was served")
+	}
+	if authRequest(t, paths, clientCertRequest(forged)) {
+		t.Error("certificate from another CA was served")
+	}
+	if authRequest(t, paths, httptest.NewRequest("GET", "/index.html", nil)) {
+		t.Error("request without a certificate was served")
+	}
+}
+
+func TestPaths_MatchAndServe_auth_client_cert_path_ca(t *testing.T) {
+	globalCA, globalKey := newCert(t, "operators", nil, nil, nil)
+	pathCA, pathKey := newCert(t, "red team", nil, nil, nil)
+	operator, _ := newCert(t, "alice", nil, globalCA, globalKey)
+	redTeam, _ := newCert(t, "bob", nil, pathCA, pathKey)
+
+	caDir, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer caDir.Close()
+	globalFile := writeCA(t, caDir.Path, "global.pem", globalCA)
+	pathFile := writeCA(t, caDir.Path, "path.pem", pathCA)
+
+	// The CA of the path is not in ssl.client_ca
+	paths, serverRoot := authPaths(t, "  client_cert:", "    ca: "+pathFile)
+	defer serverRoot.Close()
+	if err := paths.AddClientCA(globalFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if !authRequest(t, paths, clientCertRequest(redTeam)) {
+		t.Error("certificate from the CA of the path was not served")
+	}
+	if authRequest(t, paths, clientCertRequest(operator)) {
+		t.Error("certificate from ssl.client_ca was served on a path with its own CA")
+	}
+}
+
+func TestPaths_MatchAndServe_auth_client_cert_global_ca(t *testing.T) {
+	globalCA, globalKey := newCert(t, "operators", nil, nil, nil)
+	otherCA, otherKey := newCert(t, "other", nil, nil, nil)
+	operator, _ := newCert(t, "alice", nil, globalCA, globalKey)
+	stranger, _ := newCert(t, "mallory", nil, otherCA, otherKey)
+
+	caDir, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer caDir.Close()
+
+	paths, serverRoot := authPaths(t, "  client_cert: {}")
+	defer serverRoot.Close()
+	if authRequest(t, paths, clientCertRequest(operator)) {
+		t.Error("certificate was served without a CA")
+	}
+
+	if err := paths.AddClientCA(writeCA(t, caDir.Path, "global.pem", globalCA)); err != nil {
+		t.Fatal(err)
+	}
+	if !authRequest(t, paths, clientCertRequest(operator)) {
+		t.Error("certificate from ssl.client_ca was not served")
+	}
+	if authRequest(t, paths, clientCertRequest(stranger)) {
+		t.Error("certificate from another CA was served")
+	}
+}
+
+func TestPaths_AddClientCA_bad(t *testing.T) {
+	paths, serverRoot := authPaths(t, "  bearer: [s3cret]")
+	defer serverRoot.Close()
+
+	// The htpasswd file is not a CA bundle
+	if err := paths.AddClientCA(filepath.Join(serverRoot.Path, ".htpasswd")); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,208 @@
+package path
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+)
+
+// DefaultMaxBodySize is the largest body read by the body conditions when max_body_size is not set
+const DefaultMaxBodySize = 1 << 20
+
+// ErrBodyTooLarge is returned when a body is larger than max_body_size
+var ErrBodyTooLarge = errors.New("request body is larger than max_body_size")
+
+// readCloser joins the reader which replays the body with the original Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// peekBody reads up to limit bytes of the body and puts them back, so the
+// body can still be read by the file server, proxy or a later condition
+func peekBody(req *http.Request, limit int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// jsonPath finds the value at a dot separated path, such as user.emails.0
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonString formats a JSON value so it can be matched by a regex. Strings
+// are used as they are and everything else is JSON encoded
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+// formValues parses URL encoded and multipart form bodies
+func formValues(req *http.Request, body []byte) (url.Values, error) {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return url.ParseQuery(string(body))
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(int64(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		defer form.RemoveAll()
+		return url.Values(form.Value), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("%s is not a form", mediaType))
+}
+
+func (c *RequestConditions) maxBodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+func (c *RequestConditions) bodyMatch(req *http.Request) bool {
+	if len(c.BodyRegex) == 0 && len(c.BodyJSONPath) == 0 && len(c.FormField) == 0 {
+		log.Trace("No body conditions")
+		return true
+	}
+
+	body, err := peekBody(req, c.maxBodySize())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Unable to read request body")
+		return false
+	}
+
+	// Body regex
+	if len(c.BodyRegex) != 0 {
+		correctBody := false
+		for _, r := range c.BodyRegex {
+			re := regexp.MustCompile(r)
+			if re.Match(body) {
+				log.WithFields(log.Fields{
+					"body_regex": r,
+				}).Debug("Matched body regex")
+				correctBody = true
+				break
+			}
+			log.WithFields(log.Fields{
+				"body_regex": r,
+			}).Trace("Did not match body regex")
+		}
+		if !correctBody {
+			return false
+		}
+	}
+
+	// JSON path
+	if len(c.BodyJSONPath) != 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Debug("Request body is not JSON")
+			return false
+		}
+		for p, r := range c.BodyJSONPath {
+			v, ok := jsonPath(doc, p)
+			if !ok || !regexp.MustCompile(r).MatchString(jsonString(v)) {
+				log.WithFields(log.Fields{
+					"json_path":  p,
+					"json_regex": r,
+				}).Debug("Did not match JSON path")
+				return false
+			}
+			log.WithFields(log.Fields{
+				"json_path":  p,
+				"json_regex": r,
+			}).Debug("Matched JSON path")
+		}
+	}
+
+	// Form fields
+	if len(c.FormField) != 0 {
+		form, err := formValues(req, body)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Debug("Unable to parse form")
+			return false
+		}
+		for k, r := range c.FormField {
+			if !matchValues(form[k], r) {
+				log.WithFields(log.Fields{
+					"form_field": k,
+					"form_regex": r,
+				}).Debug("Did not match form field")
+				return false
+			}
+			log.WithFields(log.Fields{
+				"form_field": k,
+				"form_regex": r,
+			}).Debug("Matched form field")
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,131 @@
+package path_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+func shouldHostBody(t *testing.T, contentType, body, data string) bool {
+	mockRequest := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	if contentType != "" {
+		mockRequest.Header.Set("Content-Type", contentType)
+	}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	ok := conditions.ShouldHost(mockRequest, state, geoip.DB{})
+
+	// The body must still be readable after the conditions ran
+	rest, err := ioutil.ReadAll(mockRequest.Body)
+	if err != nil || string(rest) != body {
+		t.Errorf("body was not preserved: %q", rest)
+	}
+	return ok
+}
+
+func TestRequestConditions_ShouldHost_body_regex_succeed(t *testing.T) {
+	if !shouldHostBody(t, "text/plain", "username=admin&password=hunter2", "body_regex: ['password=\\w+']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_body_regex_fail(t *testing.T) {
+	if shouldHostBody(t, "text/plain", "nothing to see", "body_regex: ['password=\\w+']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_body_json_succeed(t *testing.T) {
+	body := `{"user": {"emails": ["alice@example.com"], "admin": true}}`
+	data := `
+body_json_path:
+  user.emails.0: '@example\.com$'
+  user.admin: '^true$'
+`
+	if !shouldHostBody(t, "application/json", body, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_body_json_missing(t *testing.T) {
+	body := `{"user": {"emails": []}}`
+	if shouldHostBody(t, "application/json", body, "body_json_path:\n  user.emails.0: '.*'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_body_json_invalid(t *testing.T) {
+	if shouldHostBody(t, "application/json", "not json", "body_json_path:\n  user: '.*'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_form_field_succeed(t *testing.T) {
+	if !shouldHostBody(t, "application/x-www-form-urlencoded", "rid=a1b2c3&email=bob%40example.com", "form_field:\n  email: '^bob@'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_form_field_fail(t *testing.T) {
+	if shouldHostBody(t, "application/x-www-form-urlencoded", "rid=a1b2c3", "form_field:\n  email: '.*'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_form_field_multipart(t *testing.T) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("token", "abc123")
+	w.Close()
+
+	if !shouldHostBody(t, w.FormDataContentType(), buf.String(), "form_field:\n  token: '^abc'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_body_too_large(t *testing.T) {
+	data := `
+max_body_size: 8
+body_regex: ['.*']
+`
+	if shouldHostBody(t, "text/plain", "this body is longer than eight bytes", data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_body_empty(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("body_regex: ['^$']"))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+}
@@ -2,49 +2,161 @@ package path
 
 import (
 	"net"
+	"sync"
+	"time"
 )
 
-// ClientID is client identification
+// maxHistory is the number of hits kept for each client. Strict chains only
+// compare the latest hits, so it only limits subsequence and any chains
+const maxHistory = 256
+
+// ClientID is client identification. Clients are identified by their IP or
+// by a session cookie issued by satellite. It is safe for concurrent use
 type ClientID struct {
-	list map[string][]string
+	mu        sync.Mutex
+	list      map[string][]clientHit
+	retention time.Duration
+	nextSweep time.Time
+}
+
+// clientHit is a path a client hit and when it hit it
+type clientHit struct {
+	path string
+	at   time.Time
 }
 
 // NewClientID creates a new ClientID object
 func NewClientID() *ClientID {
 	return &ClientID{
-		list: make(map[string][]string),
+		list: make(map[string][]clientHit),
 	}
 }
 
-// Hit notifies ClientID that an IP hit a target
-func (c *ClientID) Hit(ip net.IP, path string) {
-	ipstr := ip.String()
-	c.list[ipstr] = append(c.list[ipstr], path)
+// SetRetention sets how long hits are kept. Clients without newer hits are
+// forgotten. Hits are kept indefinitely when it is zero
+func (c *ClientID) SetRetention(retention time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retention = retention
+	c.nextSweep = time.Time{}
 }
 
-// Match asks ClientID if the target IP has succeeded in hitting the prereqs
-func (c *ClientID) Match(ip net.IP, targetList []string) bool {
-	if len(targetList) == 0 {
-		return true
+// clientKey returns the canonical form of an IP. IPv4-mapped IPv6 addresses
+// share a key with their IPv4 form and IPv6 addresses are keyed in their
+// shortest form, however they were written
+func clientKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
 	}
+	return ip.String()
+}
+
+func ipKey(ip net.IP) string {
+	return "ip/" + clientKey(ip)
+}
 
-	ipstr := ip.String()
-	list, ok := c.list[ipstr]
-	if !ok {
-		return false
+func sessionKey(session string) string {
+	return "session/" + session
+}
+
+func (c *ClientID) hit(key, path string) {
+	t := now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(t)
+	c.add(key, path, t)
+}
+
+func (c *ClientID) add(key, path string, t time.Time) {
+	hits := append(c.list[key], clientHit{path: path, at: t})
+	if len(hits) > maxHistory {
+		hits = hits[len(hits)-maxHistory:]
 	}
+	c.list[key] = hits
+}
 
-	if len(targetList) > len(list) {
-		return false
+// sweep removes hits older than the retention and forgets clients without
+// hits, at most once a minute or once per retention when it is shorter
+func (c *ClientID) sweep(t time.Time) {
+	if c.retention == 0 || t.Before(c.nextSweep) {
+		return
+	}
+	cutoff := t.Add(-c.retention)
+	for key, hits := range c.list {
+		i := 0
+		for i < len(hits) && hits[i].at.Before(cutoff) {
+			i++
+		}
+		if i == len(hits) {
+			delete(c.list, key)
+		} else if i > 0 {
+			c.list[key] = append([]clientHit(nil), hits[i:]...)
+		}
+	}
+	interval := time.Minute
+	if c.retention < interval {
+		interval = c.retention
 	}
+	c.nextSweep = t.Add(interval)
+}
 
-	lastSubset := list[len(list)-len(targetList) : ]
+// hits returns a copy of the hits of a client, oldest first
+func (c *ClientID) hits(key string) []clientHit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits := make([]clientHit, len(c.list[key]))
+	copy(hits, c.list[key])
+	return hits
+}
 
-	for i := range lastSubset {
-		if lastSubset[i] != targetList[i] {
-			return false
-		}
+// Hit notifies ClientID that an IP hit a target
+func (c *ClientID) Hit(ip net.IP, path string) {
+	c.hit(ipKey(ip), path)
+}
+
+// IssueSession creates a session which hit a target. Only issued sessions
+// are tracked, so clients can't choose their own
+func (c *ClientID) IssueSession(path string) (string, error) {
+	session, err := newSession()
+	if err != nil {
+		return "", err
+	}
+	c.hit(sessionKey(session), path)
+	return session, nil
+}
+
+// HasSession checks if a session was issued and has hits which were not forgotten
+func (c *ClientID) HasSession(session string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.list[sessionKey(session)]
+	return ok
+}
+
+// HitSession notifies ClientID that a session hit a target. Sessions which
+// were not issued, or were forgotten, are ignored
+func (c *ClientID) HitSession(session, path string) {
+	t := now()
+	key := sessionKey(session)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(t)
+	if _, ok := c.list[key]; ok {
+		c.add(key, path, t)
 	}
+}
 
-	return true
+// History returns the targets an IP hit, oldest first
+func (c *ClientID) History(ip net.IP) []string {
+	hits := c.hits(ipKey(ip))
+	history := make([]string, len(hits))
+	for i, h := range hits {
+		history[i] = h.path
+	}
+	return history
+}
+
+// Match asks ClientID if the target IP has succeeded in hitting the prereqs
+func (c *ClientID) Match(ip net.IP, targetList []string) bool {
+	return matchChain(c.hits(ipKey(ip)), targetList, PrereqStrict, 0, 0, now())
 }
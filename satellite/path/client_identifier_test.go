@@ -3,6 +3,7 @@ package path_test
 import (
 	"net"
 	"testing"
+	"time"
 
 	. "github.com/t94j0/satellite/satellite/path"
 )
@@ -89,3 +90,66 @@ func TestClientID_match_four_mod_fail(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestClientID_match_ipv6(t *testing.T) {
+	cid := NewClientID()
+	cid.Hit(net.ParseIP("2001:DB8:0:0::1"), "/")
+	if !cid.Match(net.ParseIP("2001:db8::1"), []string{"/"}) {
+		t.Fail()
+	}
+	if cid.Match(net.ParseIP("2001:db8::2"), []string{"/"}) {
+		t.Fail()
+	}
+}
+
+func TestClientID_match_ipv4_mapped(t *testing.T) {
+	cid := NewClientID()
+	cid.Hit(net.ParseIP("::ffff:127.0.0.1"), "/")
+	if !cid.Match(net.ParseIP("127.0.0.1"), []string{"/"}) {
+		t.Fail()
+	}
+}
+
+func TestClientID_retention(t *testing.T) {
+	cid := NewClientID()
+	cid.SetRetention(20 * time.Millisecond)
+	cid.Hit(net.ParseIP("127.0.0.1"), "/")
+	time.Sleep(30 * time.Millisecond)
+	cid.Hit(net.ParseIP("127.0.0.2"), "/")
+	if len(cid.History(net.ParseIP("127.0.0.1"))) != 0 {
+		t.Fail()
+	}
+	if len(cid.History(net.ParseIP("127.0.0.2"))) != 1 {
+		t.Fail()
+	}
+}
+
+func TestClientID_retention_unset(t *testing.T) {
+	cid := NewClientID()
+	cid.SetRetention(0)
+	cid.Hit(net.ParseIP("127.0.0.1"), "/")
+	time.Sleep(30 * time.Millisecond)
+	cid.Hit(net.ParseIP("127.0.0.2"), "/")
+	if len(cid.History(net.ParseIP("127.0.0.1"))) != 1 {
+		t.Fail()
+	}
+}
+
+func TestClientID_IssueSession(t *testing.T) {
+	cid := NewClientID()
+	session, err := cid.IssueSession("/")
+	if err != nil {
+		t.Error(err)
+	}
+	if !cid.HasSession(session) {
+		t.Fail()
+	}
+}
+
+func TestClientID_HitSession_not_issued(t *testing.T) {
+	cid := NewClientID()
+	cid.HitSession("chosen-by-client", "/")
+	if cid.HasSession("chosen-by-client") {
+		t.Fail()
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
-	"os/exec"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gobwas/glob"
@@ -14,8 +15,8 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/t94j0/satellite/net/http"
-	"github.com/t94j0/satellite/net/http/httputil"
 	"github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/util"
 	"gopkg.in/yaml.v2"
 )
 
@@ -29,6 +30,22 @@ type RequestConditions struct {
 	AuthorizedUserAgentsGlob []string `yaml:"authorized_useragents_glob,omitempty"`
 	// BlacklistUserAgentsGlob are blacklisted user agents
 	BlacklistUserAgentsGlob []string `yaml:"blacklist_useragents_glob,omitempty"`
+	// AuthorizedLanguages are language ranges the client must accept. A range may carry a minimum q-value, such as de;q=0.5
+	AuthorizedLanguages []string `yaml:"authorized_languages,omitempty"`
+	// BlacklistLanguages are language ranges the client must not accept
+	BlacklistLanguages []string `yaml:"blacklist_languages,omitempty"`
+	// AuthorizedReferers is the authorized Referer header regexes
+	AuthorizedReferers []string `yaml:"authorized_referers,omitempty"`
+	// BlacklistReferers are blacklisted Referer header regexes
+	BlacklistReferers []string `yaml:"blacklist_referers,omitempty"`
+	// AuthorizedReferersGlob is the authorized Referer header globs
+	AuthorizedReferersGlob []string `yaml:"authorized_referers_glob,omitempty"`
+	// BlacklistReferersGlob are blacklisted Referer header globs
+	BlacklistReferersGlob []string `yaml:"blacklist_referers_glob,omitempty"`
+	// AuthorizedHosts is the authorized Host header globs
+	AuthorizedHosts []string `yaml:"authorized_hosts,omitempty"`
+	// BlacklistHosts are blacklisted Host header globs
+	BlacklistHosts []string `yaml:"blacklist_hosts,omitempty"`
 	// AuthorizedIPRange is the authorized range of IPs who are allowed to access a file
 	AuthorizedIPRange []string `yaml:"authorized_iprange,omitempty"`
 	// BlacklistIPRange are blacklisted IPs
@@ -37,23 +54,128 @@ type RequestConditions struct {
 	AuthorizedMethods []string `yaml:"authorized_methods,omitempty"`
 	// AuthorizedHeaders are HTTP headers which must be present in order to access a file
 	AuthorizedHeaders map[string]string `yaml:"authorized_headers,omitempty"`
+	// AuthorizedHeadersRegex are HTTP headers whose value must match a regex
+	AuthorizedHeadersRegex map[string]string `yaml:"authorized_headers_regex,omitempty"`
+	// AuthorizedHeadersGlob are HTTP headers whose value must match a glob
+	AuthorizedHeadersGlob map[string]string `yaml:"authorized_headers_glob,omitempty"`
+	// HeadersRequireAll requires every authorized header to match instead of any one of them
+	HeadersRequireAll bool `yaml:"headers_require_all,omitempty"`
+	// AuthorizedQuery are query parameters whose value must match a regex. Every parameter must match
+	AuthorizedQuery map[string]string `yaml:"authorized_query,omitempty"`
+	// BlacklistQuery are query parameters which block access when their value matches a regex
+	BlacklistQuery map[string]string `yaml:"blacklist_query,omitempty"`
+	// AuthorizedCookies are cookies whose value must match a regex. Every cookie must match
+	AuthorizedCookies map[string]string `yaml:"authorized_cookies,omitempty"`
+	// BlacklistCookies are cookies which block access when their value matches a regex
+	BlacklistCookies map[string]string `yaml:"blacklist_cookies,omitempty"`
+	// BodyRegex are regexes of which one must match the request body
+	BodyRegex []string `yaml:"body_regex,omitempty"`
+	// BodyJSONPath are dot separated paths into a JSON body, such as user.emails.0, whose value must match a regex
+	BodyJSONPath map[string]string `yaml:"body_json_path,omitempty"`
+	// FormField are URL encoded or multipart form fields whose value must match a regex
+	FormField map[string]string `yaml:"form_field,omitempty"`
+	// MaxBodySize is the largest body in bytes the body conditions read. Larger bodies fail them
+	MaxBodySize int64 `yaml:"max_body_size,omitempty"`
+	// ForbiddenHeaders are HTTP headers, such as Via, which block access when present
+	ForbiddenHeaders []string `yaml:"forbidden_headers,omitempty"`
 	// AuthorizedJA3 are valid JA3 hashes
 	AuthorizedJA3 []string `yaml:"authorized_ja3,omitempty"`
+	// BlacklistJA3 are blacklisted JA3 hashes
+	BlacklistJA3 []string `yaml:"blacklist_ja3,omitempty"`
+	// AuthorizedJA3Glob are globs matched against the raw JA3 string
+	AuthorizedJA3Glob []string `yaml:"authorized_ja3_glob,omitempty"`
+	// BlacklistJA3Glob are blacklisted globs matched against the raw JA3 string
+	BlacklistJA3Glob []string `yaml:"blacklist_ja3_glob,omitempty"`
+	// JA3Normalized matches all JA3 conditions against the JA3N string, where
+	// the extensions are sorted so that clients which shuffle them keep one fingerprint
+	JA3Normalized bool `yaml:"ja3_normalized,omitempty"`
+	// AuthorizedJA4 are valid JA4 fingerprints
+	AuthorizedJA4 []string `yaml:"authorized_ja4,omitempty"`
+	// BlacklistJA4 are blacklisted JA4 fingerprints
+	BlacklistJA4 []string `yaml:"blacklist_ja4,omitempty"`
+	// AuthorizedJA4H are valid JA4H fingerprints
+	AuthorizedJA4H []string `yaml:"authorized_ja4h,omitempty"`
+	// BlacklistJA4H are blacklisted JA4H fingerprints
+	BlacklistJA4H []string `yaml:"blacklist_ja4h,omitempty"`
+	// AuthorizedSNI are globs of TLS server names which can access a file
+	AuthorizedSNI []string `yaml:"authorized_sni,omitempty"`
+	// MinTLSVersion is the lowest negotiated TLS version, such as 1.2, which can access a file
+	MinTLSVersion string `yaml:"min_tls_version,omitempty"`
+	// RequiredALPN are ALPN protocols, such as h2, which the client must offer
+	RequiredALPN []string `yaml:"required_alpn,omitempty"`
+	// AuthorizedCiphers are negotiated cipher suites, such as TLS_AES_128_GCM_SHA256, which can access a file
+	AuthorizedCiphers []string `yaml:"authorized_ciphers,omitempty"`
+	// BlacklistCiphers are blacklisted negotiated cipher suites
+	BlacklistCiphers []string `yaml:"blacklist_ciphers,omitempty"`
+	// RequireSNIMatch requires a TLS server name equal to the Host header, which catches domain fronting and IP-only scanners
+	RequireSNIMatch bool `yaml:"require_sni_match,omitempty"`
 	// Exec file executes script/binary and checks stdout
-	Exec struct {
-		ScriptPath string `yaml:"script"`
-		Output     string `yaml:"output"`
-	} `yaml:"exec,omitempty"`
+	Exec Exec `yaml:"exec,omitempty"`
+	// Webhook asks a decision service if the file should be served
+	Webhook Webhook `yaml:"webhook,omitempty"`
+	// Script is a Starlark script defining allow(request, hits), which returns
+	// if the file should be served
+	Script string `yaml:"script,omitempty"`
 	// NotServing does not serve the page when NotServing is true
 	NotServing bool `yaml:"not_serving,omitempty"`
 	// Serve is the number of times the file should be served
 	Serve uint64 `yaml:"serve,omitempty"`
+	// ServePerIP is the number of times the file should be served to each IP
+	ServePerIP uint64 `yaml:"serve_per_ip,omitempty"`
+	// ServePerSession is the number of times the file should be served to each
+	// session cookie. Requests without the cookie are not served
+	ServePerSession uint64 `yaml:"serve_per_session,omitempty"`
+	// SessionCookie is the name of the cookie used by serve_per_session
+	SessionCookie string `yaml:"session_cookie,omitempty"`
+	// ServePerJA3 is the number of times the file should be served to each JA3N fingerprint
+	ServePerJA3 uint64 `yaml:"serve_per_ja3,omitempty"`
+	// RateLimit are limits on the number of requests each client can make.
+	// Limits from the global conditions and the path are all enforced
+	RateLimit []RateLimit `yaml:"rate_limit,omitempty"`
 	// PrereqPaths path of hits that need to happen before the current one will succeed
 	PrereqPaths []string `yaml:"prereq,omitempty"`
-	GeoIP       struct {
+	// PrereqOptions changes how the prereq chain is tracked and matched
+	PrereqOptions PrereqOptions `yaml:"prereq_options,omitempty"`
+	// NotBefore is the RFC 3339 time before which the file is not served
+	NotBefore string `yaml:"not_before,omitempty"`
+	// NotAfter is the RFC 3339 time after which the file is not served
+	NotAfter string `yaml:"not_after,omitempty"`
+	// Schedule are recurring time windows. The file is only served while one of them is open
+	Schedule []TimeWindow `yaml:"schedule,omitempty"`
+	// AuthorizedRDNSGlob are globs of forward-confirmed reverse DNS hostnames which can access a file
+	AuthorizedRDNSGlob []string `yaml:"authorized_rdns_glob,omitempty"`
+	// BlacklistRDNSGlob are globs of blacklisted forward-confirmed reverse DNS hostnames
+	BlacklistRDNSGlob []string `yaml:"blacklist_rdns_glob,omitempty"`
+	// AuthorizedASN are autonomous system numbers, such as AS15169, which can access a file
+	AuthorizedASN []string `yaml:"authorized_asn,omitempty"`
+	// BlacklistASN are blacklisted autonomous system numbers
+	BlacklistASN []string `yaml:"blacklist_asn,omitempty"`
+	// AuthorizedASNOrg are regexes of autonomous system organizations which can access a file
+	AuthorizedASNOrg []string `yaml:"authorized_asn_org,omitempty"`
+	// BlacklistASNOrg are regexes of blacklisted autonomous system organizations
+	BlacklistASNOrg []string `yaml:"blacklist_asn_org,omitempty"`
+	GeoIP           struct {
 		AuthorizedCountries []string `yaml:"authorized_countries"`
 		BlacklistCountries  []string `yaml:"blacklist_countries"`
+		// AuthorizedRegions are ISO 3166-2 region codes, such as US-CA, which can access a file
+		AuthorizedRegions []string `yaml:"authorized_regions,omitempty"`
+		// BlacklistRegions are blacklisted ISO 3166-2 region codes
+		BlacklistRegions []string `yaml:"blacklist_regions,omitempty"`
+		// AuthorizedCities are the English names of cities which can access a file
+		AuthorizedCities []string `yaml:"authorized_cities,omitempty"`
+		// BlacklistCities are the English names of blacklisted cities
+		BlacklistCities []string `yaml:"blacklist_cities,omitempty"`
+		// Geofence are areas a client must be in to access a file
+		Geofence []Geofence `yaml:"geofence,omitempty"`
 	} `yaml:"geoip"`
+	// Scoring weights conditions and serves when their score reaches a minimum
+	Scoring Scoring `yaml:"scoring,omitempty"`
+	// AllOf are nested condition blocks which must all match
+	AllOf []RequestConditions `yaml:"all_of,omitempty"`
+	// AnyOf are nested condition blocks where at least one must match
+	AnyOf []RequestConditions `yaml:"any_of,omitempty"`
+	// Not are nested condition blocks where none may match
+	Not []RequestConditions `yaml:"not,omitempty"`
 }
 
 // NewRequestConditions creates an object based on a YAML blob
@@ -64,24 +186,150 @@ func NewRequestConditions(data []byte) (RequestConditions, error) {
 		return conditions, err
 	}
 
-	regexes := append(conditions.AuthorizedUserAgents, conditions.BlacklistUserAgents...)
+	if err := conditions.Validate(); err != nil {
+		return conditions, err
+	}
+
+	return conditions, nil
+}
+
+// Validate ensures all regexes and globs compile, including the ones in nested condition blocks
+func (c *RequestConditions) Validate() error {
+	var regexes []string
+	regexes = append(regexes, c.AuthorizedUserAgents...)
+	regexes = append(regexes, c.BlacklistUserAgents...)
+	regexes = append(regexes, c.AuthorizedReferers...)
+	regexes = append(regexes, c.BlacklistReferers...)
+	regexes = append(regexes, c.AuthorizedASNOrg...)
+	regexes = append(regexes, c.BlacklistASNOrg...)
+	regexes = append(regexes, c.BodyRegex...)
+	for _, m := range []map[string]string{c.AuthorizedHeadersRegex, c.AuthorizedQuery, c.BlacklistQuery, c.AuthorizedCookies, c.BlacklistCookies, c.BodyJSONPath, c.FormField} {
+		for _, re := range m {
+			regexes = append(regexes, re)
+		}
+	}
 	for _, ua := range regexes {
 		if _, err := regexp.Compile(ua); err != nil {
-			return conditions, errors.New(fmt.Sprintf("%s is not valid regex", ua))
+			return errors.New(fmt.Sprintf("%s is not valid regex", ua))
 		}
 	}
 
-	globs := append(conditions.AuthorizedUserAgentsGlob, conditions.BlacklistUserAgentsGlob...)
+	var globs []string
+	globs = append(globs, c.AuthorizedUserAgentsGlob...)
+	globs = append(globs, c.BlacklistUserAgentsGlob...)
+	globs = append(globs, c.AuthorizedReferersGlob...)
+	globs = append(globs, c.BlacklistReferersGlob...)
+	globs = append(globs, c.AuthorizedHosts...)
+	globs = append(globs, c.BlacklistHosts...)
+	globs = append(globs, c.AuthorizedJA3Glob...)
+	globs = append(globs, c.BlacklistJA3Glob...)
+	globs = append(globs, c.AuthorizedRDNSGlob...)
+	globs = append(globs, c.BlacklistRDNSGlob...)
+	globs = append(globs, c.AuthorizedSNI...)
+	for _, g := range c.AuthorizedHeadersGlob {
+		globs = append(globs, g)
+	}
 	for _, ua := range globs {
 		if _, err := glob.Compile(ua); err != nil {
-			return conditions, errors.New(fmt.Sprintf("%s is not valid glob", ua))
+			return errors.New(fmt.Sprintf("%s is not valid glob", ua))
 		}
 	}
 
-	return conditions, nil
+	var languages []string
+	languages = append(languages, c.AuthorizedLanguages...)
+	languages = append(languages, c.BlacklistLanguages...)
+	for _, l := range languages {
+		if _, err := parseLanguageRange(l); err != nil {
+			return err
+		}
+	}
+
+	var asns []string
+	asns = append(asns, c.AuthorizedASN...)
+	asns = append(asns, c.BlacklistASN...)
+	for _, asn := range asns {
+		if _, err := ParseASN(asn); err != nil {
+			return err
+		}
+	}
+
+	for i, g := range c.GeoIP.Geofence {
+		if err := g.Validate(); err != nil {
+			return errors.Wrapf(err, "geofence[%d]", i)
+		}
+	}
+
+	if c.MinTLSVersion != "" {
+		if _, err := parseTLSVersion(c.MinTLSVersion); err != nil {
+			return err
+		}
+	}
+
+	ciphers := append([]string{}, c.AuthorizedCiphers...)
+	ciphers = append(ciphers, c.BlacklistCiphers...)
+	for _, cipher := range ciphers {
+		if _, err := parseCipherSuite(cipher); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateSchedule(); err != nil {
+		return err
+	}
+
+	if err := c.validateRateLimits(); err != nil {
+		return err
+	}
+
+	if err := c.PrereqOptions.Validate(); err != nil {
+		return errors.Wrap(err, "prereq_options")
+	}
+
+	if err := c.Exec.Validate(); err != nil {
+		return errors.Wrap(err, "exec")
+	}
+
+	if c.Webhook.URL != "" {
+		if err := c.Webhook.Validate(); err != nil {
+			return errors.Wrap(err, "webhook")
+		}
+	}
+
+	if c.Script != "" {
+		if _, err := loadScript("script", 1, c.Script); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Scoring.Validate(); err != nil {
+		return errors.Wrap(err, "scoring")
+	}
+
+	if err := validateBlocks("all_of", c.AllOf); err != nil {
+		return err
+	}
+	if err := validateBlocks("any_of", c.AnyOf); err != nil {
+		return err
+	}
+	if err := validateBlocks("not", c.Not); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateBlocks(name string, blocks []RequestConditions) error {
+	for i := range blocks {
+		if err := blocks[i].Validate(); err != nil {
+			return errors.Wrapf(err, "%s[%d]", name, i)
+		}
+	}
+	return nil
 }
 
 // MergeRequestConditions merges a list of RequestCondition. They are applied starting from the first to the last. It will overwrite later RequestCondition
+//
+// Nested all_of, any_of and not blocks are appended rather than merged into each other, so every block keeps its own meaning
 func MergeRequestConditions(conds ...RequestConditions) (RequestConditions, error) {
 	var target RequestConditions
 	for _, c := range conds {
@@ -92,11 +340,6 @@ func MergeRequestConditions(conds ...RequestConditions) (RequestConditions, erro
 	return target, nil
 }
 
-func parseRemoteAddr(ipPort string) net.IP {
-	targetIP := strings.Split(ipPort, ":")[0]
-	return net.ParseIP(targetIP)
-}
-
 func (c *RequestConditions) authorizedUserAgents(req *http.Request) bool {
 	correctAgent := false
 	userAgent := req.UserAgent()
@@ -202,7 +445,7 @@ func (c *RequestConditions) blacklistUserAgentsGlob(req *http.Request) bool {
 }
 
 func (c *RequestConditions) authorizedIPRange(req *http.Request) bool {
-	targetHost := parseRemoteAddr(req.RemoteAddr)
+	targetHost := util.GetHost(req)
 	correctRange := false
 
 	if len(c.AuthorizedIPRange) == 0 {
@@ -247,7 +490,7 @@ func (c *RequestConditions) authorizedIPRange(req *http.Request) bool {
 }
 
 func (c *RequestConditions) blacklistIPRange(req *http.Request) bool {
-	targetHost := parseRemoteAddr(req.RemoteAddr)
+	targetHost := util.GetHost(req)
 
 	if len(c.BlacklistIPRange) == 0 {
 		return true
@@ -301,36 +544,249 @@ func (c *RequestConditions) authorizedMethods(req *http.Request) bool {
 	return false
 }
 
-func (c *RequestConditions) authorizedHeaders(req *http.Request) bool {
-	correctHeaders := false
+// headerValues returns every value of a header. The Host header is taken from the request line
+func headerValues(req *http.Request, key string) []string {
+	if http.CanonicalHeaderKey(key) == "Host" {
+		if req.Host == "" {
+			return nil
+		}
+		return []string{req.Host}
+	}
+	return req.Header[http.CanonicalHeaderKey(key)]
+}
 
-	if len(c.AuthorizedHeaders) == 0 {
-		log.Trace("No authorized methods")
+// matchHeader checks if any value of the header matches
+func matchHeader(req *http.Request, key string, match func(string) bool) bool {
+	for _, v := range headerValues(req, key) {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RequestConditions) authorizedHeaders(req *http.Request) bool {
+	total := len(c.AuthorizedHeaders) + len(c.AuthorizedHeadersRegex) + len(c.AuthorizedHeadersGlob)
+	if total == 0 {
+		log.Trace("No authorized headers")
 		return true
 	}
 
-	for k, v := range c.AuthorizedHeaders {
-		if req.Header.Get(k) == v {
+	matched := 0
+	check := func(k, v string, match func(string) bool) {
+		if matchHeader(req, k, match) {
 			log.WithFields(log.Fields{
 				"header_key":   k,
 				"header_value": v,
 			}).Debug("Matched header")
-			correctHeaders = true
+			matched++
+		} else {
+			log.WithFields(log.Fields{
+				"header_key":   k,
+				"header_value": v,
+			}).Trace("Did not match header")
+		}
+	}
+
+	for k, v := range c.AuthorizedHeaders {
+		value := v
+		check(k, v, func(h string) bool { return h == value })
+	}
+	for k, v := range c.AuthorizedHeadersRegex {
+		re := regexp.MustCompile(v)
+		check(k, v, re.MatchString)
+	}
+	for k, v := range c.AuthorizedHeadersGlob {
+		g := glob.MustCompile(v)
+		check(k, v, g.Match)
+	}
+
+	if c.HeadersRequireAll {
+		return matched == total
+	}
+	return matched > 0
+}
+
+func (c *RequestConditions) forbiddenHeaders(req *http.Request) bool {
+	if len(c.ForbiddenHeaders) == 0 {
+		log.Trace("No forbidden headers")
+		return true
+	}
+
+	for _, k := range c.ForbiddenHeaders {
+		if len(headerValues(req, k)) != 0 {
+			log.WithFields(log.Fields{
+				"header_key": k,
+			}).Debug("Matched forbidden header")
+			return false
 		}
 		log.WithFields(log.Fields{
-			"header_key":   k,
-			"header_value": v,
-		}).Trace("Did not match header")
+			"header_key": k,
+		}).Trace("Did not match forbidden header")
 	}
 
-	return correctHeaders
+	return true
+}
+
+// queryValues returns every value of a query parameter
+func queryValues(req *http.Request, key string) []string {
+	if req.URL == nil {
+		return nil
+	}
+	return req.URL.Query()[key]
+}
+
+// cookieValues returns the value of every cookie with the name
+func cookieValues(req *http.Request, name string) []string {
+	var values []string
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == name {
+			values = append(values, cookie.Value)
+		}
+	}
+	return values
+}
+
+// matchValues checks if any of the values match the regex
+func matchValues(values []string, pattern string) bool {
+	re := regexp.MustCompile(pattern)
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RequestConditions) authorizedQuery(req *http.Request) bool {
+	if len(c.AuthorizedQuery) == 0 {
+		log.Trace("No authorized query parameters")
+		return true
+	}
+
+	for k, v := range c.AuthorizedQuery {
+		if !matchValues(queryValues(req, k), v) {
+			log.WithFields(log.Fields{
+				"query_key":   k,
+				"query_value": v,
+			}).Debug("Did not match authorized query parameter")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"query_key":   k,
+			"query_value": v,
+		}).Debug("Matched authorized query parameter")
+	}
+
+	return true
+}
+
+func (c *RequestConditions) blacklistQuery(req *http.Request) bool {
+	if len(c.BlacklistQuery) == 0 {
+		log.Trace("No blacklisted query parameters")
+		return true
+	}
+
+	for k, v := range c.BlacklistQuery {
+		if matchValues(queryValues(req, k), v) {
+			log.WithFields(log.Fields{
+				"query_key":   k,
+				"query_value": v,
+			}).Debug("Matched blacklisted query parameter")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"query_key":   k,
+			"query_value": v,
+		}).Trace("Did not match blacklisted query parameter")
+	}
+
+	return true
+}
+
+func (c *RequestConditions) authorizedCookies(req *http.Request) bool {
+	if len(c.AuthorizedCookies) == 0 {
+		log.Trace("No authorized cookies")
+		return true
+	}
+
+	for k, v := range c.AuthorizedCookies {
+		if !matchValues(cookieValues(req, k), v) {
+			log.WithFields(log.Fields{
+				"cookie_name":  k,
+				"cookie_value": v,
+			}).Debug("Did not match authorized cookie")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"cookie_name":  k,
+			"cookie_value": v,
+		}).Debug("Matched authorized cookie")
+	}
+
+	return true
+}
+
+func (c *RequestConditions) blacklistCookies(req *http.Request) bool {
+	if len(c.BlacklistCookies) == 0 {
+		log.Trace("No blacklisted cookies")
+		return true
+	}
+
+	for k, v := range c.BlacklistCookies {
+		if matchValues(cookieValues(req, k), v) {
+			log.WithFields(log.Fields{
+				"cookie_name":  k,
+				"cookie_value": v,
+			}).Debug("Matched blacklisted cookie")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"cookie_name":  k,
+			"cookie_value": v,
+		}).Trace("Did not match blacklisted cookie")
+	}
+
+	return true
+}
+
+// ja3 returns the JA3 string of the request, normalized to JA3N if the conditions require it
+func (c *RequestConditions) ja3(req *http.Request) string {
+	if c.JA3Normalized {
+		return NormalizeJA3(req.JA3Fingerprint)
+	}
+	return req.JA3Fingerprint
+}
+
+// ja3Hash returns the MD5 hash of the JA3 string of the request
+func (c *RequestConditions) ja3Hash(req *http.Request) string {
+	hash := md5.Sum([]byte(c.ja3(req)))
+	return hex.EncodeToString(hash[:])
+}
+
+// NormalizeJA3 converts a JA3 string to JA3N by sorting the extensions numerically
+func NormalizeJA3(ja3 string) string {
+	fields := strings.Split(ja3, ",")
+	if len(fields) != 5 || fields[2] == "" {
+		return ja3
+	}
+
+	extensions := strings.Split(fields[2], "-")
+	sort.Slice(extensions, func(i, j int) bool {
+		a, errA := strconv.Atoi(extensions[i])
+		b, errB := strconv.Atoi(extensions[j])
+		if errA != nil || errB != nil {
+			return extensions[i] < extensions[j]
+		}
+		return a < b
+	})
+	fields[2] = strings.Join(extensions, "-")
+
+	return strings.Join(fields, ",")
 }
 
 func (c *RequestConditions) authorizedJA3(req *http.Request) bool {
-	hash := md5.Sum([]byte(req.JA3Fingerprint))
-	out := make([]byte, 32)
-	hex.Encode(out, hash[:])
-	ja3 := string(out)
+	ja3 := c.ja3Hash(req)
 
 	correctJA3 := false
 
@@ -357,36 +813,170 @@ func (c *RequestConditions) authorizedJA3(req *http.Request) bool {
 	return correctJA3
 }
 
-func (c *RequestConditions) authorizedExec(req *http.Request) bool {
-	correctExec := false
-	if c.Exec.ScriptPath != "" {
-		cmd := exec.Command(c.Exec.ScriptPath)
+func (c *RequestConditions) blacklistJA3(req *http.Request) bool {
+	if len(c.BlacklistJA3) == 0 {
+		log.Trace("No blacklisted JA3 signatures")
+		return true
+	}
 
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
+	ja3 := c.ja3Hash(req)
+	for _, j := range c.BlacklistJA3 {
+		if ja3 == j {
+			log.WithFields(log.Fields{
+				"target_ja3": j,
+				"req_ja3":    ja3,
+			}).Debug("Blacklisted JA3 signature")
 			return false
 		}
+		log.WithFields(log.Fields{
+			"target_ja3": j,
+			"req_ja3":    ja3,
+		}).Trace("Did not match blacklisted JA3 signature")
+	}
 
-		go func() {
-			defer stdin.Close()
-			dump, err := httputil.DumpRequest(req, true)
-			if err == nil {
-				stdin.Write(dump)
-			}
-		}()
+	return true
+}
 
-		out, err := cmd.CombinedOutput()
-		if err != nil {
+func (c *RequestConditions) authorizedJA3Glob(req *http.Request) bool {
+	if len(c.AuthorizedJA3Glob) == 0 {
+		log.Trace("No authorized JA3 globs")
+		return true
+	}
+
+	ja3 := c.ja3(req)
+	for _, j := range c.AuthorizedJA3Glob {
+		g := glob.MustCompile(j)
+		if g.Match(ja3) {
+			log.WithFields(log.Fields{
+				"target_ja3": j,
+				"req_ja3":    ja3,
+			}).Debug("Authorized JA3 glob matched")
+			return true
+		}
+		log.WithFields(log.Fields{
+			"target_ja3": j,
+			"req_ja3":    ja3,
+		}).Trace("Authorized JA3 glob did not match")
+	}
+
+	return false
+}
+
+func (c *RequestConditions) blacklistJA3Glob(req *http.Request) bool {
+	if len(c.BlacklistJA3Glob) == 0 {
+		log.Trace("No blacklisted JA3 globs")
+		return true
+	}
+
+	ja3 := c.ja3(req)
+	for _, j := range c.BlacklistJA3Glob {
+		g := glob.MustCompile(j)
+		if g.Match(ja3) {
+			log.WithFields(log.Fields{
+				"target_ja3": j,
+				"req_ja3":    ja3,
+			}).Debug("Blacklisted JA3 glob")
 			return false
 		}
+		log.WithFields(log.Fields{
+			"target_ja3": j,
+			"req_ja3":    ja3,
+		}).Trace("Did not match blacklisted JA3 glob")
+	}
+
+	return true
+}
+
+func (c *RequestConditions) authorizedJA4(req *http.Request) bool {
+	if len(c.AuthorizedJA4) == 0 {
+		log.Trace("No authorized JA4 signatures")
+		return true
+	}
 
-		if c.Exec.Output == strings.TrimSuffix(string(out), "\n") {
-			correctExec = true
+	for _, j := range c.AuthorizedJA4 {
+		if req.JA4Fingerprint == j {
+			log.WithFields(log.Fields{
+				"target_ja4": j,
+				"req_ja4":    req.JA4Fingerprint,
+			}).Debug("Authorized JA4 signature matched")
+			return true
 		}
-	} else {
-		correctExec = true
+		log.WithFields(log.Fields{
+			"target_ja4": j,
+			"req_ja4":    req.JA4Fingerprint,
+		}).Trace("Authorized JA4 signature did not match")
 	}
-	return correctExec
+
+	return false
+}
+
+func (c *RequestConditions) blacklistJA4(req *http.Request) bool {
+	if len(c.BlacklistJA4) == 0 {
+		log.Trace("No blacklisted JA4 signatures")
+		return true
+	}
+
+	for _, j := range c.BlacklistJA4 {
+		if req.JA4Fingerprint == j {
+			log.WithFields(log.Fields{
+				"target_ja4": j,
+				"req_ja4":    req.JA4Fingerprint,
+			}).Debug("Blacklisted JA4 signature")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"target_ja4": j,
+			"req_ja4":    req.JA4Fingerprint,
+		}).Trace("Did not match blacklisted JA4 signature")
+	}
+
+	return true
+}
+
+func (c *RequestConditions) authorizedJA4H(req *http.Request) bool {
+	if len(c.AuthorizedJA4H) == 0 {
+		log.Trace("No authorized JA4H signatures")
+		return true
+	}
+
+	for _, j := range c.AuthorizedJA4H {
+		if req.JA4HFingerprint == j {
+			log.WithFields(log.Fields{
+				"target_ja4h": j,
+				"req_ja4h":    req.JA4HFingerprint,
+			}).Debug("Authorized JA4H signature matched")
+			return true
+		}
+		log.WithFields(log.Fields{
+			"target_ja4h": j,
+			"req_ja4h":    req.JA4HFingerprint,
+		}).Trace("Authorized JA4H signature did not match")
+	}
+
+	return false
+}
+
+func (c *RequestConditions) blacklistJA4H(req *http.Request) bool {
+	if len(c.BlacklistJA4H) == 0 {
+		log.Trace("No blacklisted JA4H signatures")
+		return true
+	}
+
+	for _, j := range c.BlacklistJA4H {
+		if req.JA4HFingerprint == j {
+			log.WithFields(log.Fields{
+				"target_ja4h": j,
+				"req_ja4h":    req.JA4HFingerprint,
+			}).Debug("Blacklisted JA4H signature")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"target_ja4h": j,
+			"req_ja4h":    req.JA4HFingerprint,
+		}).Trace("Did not match blacklisted JA4H signature")
+	}
+
+	return true
 }
 
 func (c *RequestConditions) serveLimit(req *http.Request, state *State) bool {
@@ -415,29 +1005,8 @@ func (c *RequestConditions) serveLimit(req *http.Request, state *State) bool {
 	return correctServe
 }
 
-func (c *RequestConditions) prereqMatch(req *http.Request, state *State) bool {
-	filledPrereq := true
-	if len(c.PrereqPaths) == 0 {
-		return true
-	}
-
-	targetHost := parseRemoteAddr(req.RemoteAddr)
-	filledPrereq = state.MatchPaths(targetHost, c.PrereqPaths)
-	if filledPrereq {
-		log.WithFields(log.Fields{
-			"prereqs": c.PrereqPaths,
-		}).Debug("Matched prerequisites")
-	} else {
-		log.WithFields(log.Fields{
-			"prereqs": c.PrereqPaths,
-		}).Debug("Did not match prerequisites")
-	}
-
-	return filledPrereq
-}
-
 func (c *RequestConditions) geoipMatch(req *http.Request, gip geoip.DB) bool {
-	targetHost := parseRemoteAddr(req.RemoteAddr)
+	targetHost := util.GetHost(req)
 	correctGeoIP := true
 	if gip.HasDB() {
 		cc, err := gip.CountryCode(targetHost)
@@ -487,65 +1056,277 @@ func (c *RequestConditions) geoipMatch(req *http.Request, gip geoip.DB) bool {
 	return correctGeoIP
 }
 
-// ShouldHost returns when an HTTP request should be hosted or not
-func (c *RequestConditions) ShouldHost(req *http.Request, state *State, gip geoip.DB) bool {
-	// Not Serving
-	if c.NotServing {
-		log.Trace("Not serving")
-		return false
+// ParseASN parses an autonomous system number written as 15169 or AS15169
+func ParseASN(asn string) (uint, error) {
+	trimmed := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asn)), "AS")
+	n, err := strconv.ParseUint(trimmed, 10, 32)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%s is not a valid ASN", asn))
 	}
+	return uint(n), nil
+}
 
-	if ok := c.authorizedUserAgents(req); !ok {
-		return false
+func (c *RequestConditions) asnMatch(req *http.Request, gip geoip.DB) bool {
+	if len(c.AuthorizedASN) == 0 && len(c.BlacklistASN) == 0 && len(c.AuthorizedASNOrg) == 0 && len(c.BlacklistASNOrg) == 0 {
+		log.Trace("No ASN conditions")
+		return true
 	}
 
-	if ok := c.blacklistUserAgents(req); !ok {
-		return false
+	if !gip.HasASN() {
+		log.Debug("No ASN database, skipping ASN conditions")
+		return true
 	}
 
-	if ok := c.authorizedUserAgentsGlob(req); !ok {
+	asn, org, err := gip.ASN(util.GetHost(req))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Error getting ASN")
 		return false
 	}
 
-	if ok := c.blacklistUserAgentsGlob(req); !ok {
-		return false
+	// Authorized ASN
+	if len(c.AuthorizedASN) != 0 {
+		correctASN := false
+		for _, a := range c.AuthorizedASN {
+			target, _ := ParseASN(a)
+			if target == asn {
+				log.WithFields(log.Fields{
+					"target_asn": a,
+					"asn":        asn,
+				}).Debug("Matched authorized ASN")
+				correctASN = true
+			} else {
+				log.WithFields(log.Fields{
+					"target_asn": a,
+					"asn":        asn,
+				}).Trace("Did not match authorized ASN")
+			}
+		}
+		if !correctASN {
+			return false
+		}
 	}
 
-	if ok := c.authorizedIPRange(req); !ok {
-		return false
+	// Blacklist ASN
+	for _, a := range c.BlacklistASN {
+		target, _ := ParseASN(a)
+		if target == asn {
+			log.WithFields(log.Fields{
+				"target_asn": a,
+				"asn":        asn,
+			}).Debug("Matched blacklisted ASN")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"target_asn": a,
+			"asn":        asn,
+		}).Trace("Did not match blacklisted ASN")
 	}
 
-	if ok := c.blacklistIPRange(req); !ok {
-		return false
+	// Authorized organization
+	if len(c.AuthorizedASNOrg) != 0 {
+		correctOrg := false
+		for _, o := range c.AuthorizedASNOrg {
+			re := regexp.MustCompile(o)
+			if re.MatchString(org) {
+				log.WithFields(log.Fields{
+					"target_asn_org": o,
+					"asn_org":        org,
+				}).Debug("Matched authorized ASN organization")
+				correctOrg = true
+			} else {
+				log.WithFields(log.Fields{
+					"target_asn_org": o,
+					"asn_org":        org,
+				}).Trace("Did not match authorized ASN organization")
+			}
+		}
+		if !correctOrg {
+			return false
+		}
 	}
 
-	if ok := c.authorizedMethods(req); !ok {
-		return false
+	// Blacklist organization
+	for _, o := range c.BlacklistASNOrg {
+		re := regexp.MustCompile(o)
+		if re.MatchString(org) {
+			log.WithFields(log.Fields{
+				"target_asn_org": o,
+				"asn_org":        org,
+			}).Debug("Matched blacklisted ASN organization")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"target_asn_org": o,
+			"asn_org":        org,
+		}).Trace("Did not match blacklisted ASN organization")
 	}
 
-	if ok := c.authorizedHeaders(req); !ok {
-		return false
+	return true
+}
+
+func (c *RequestConditions) allOfMatch(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+	var resp *ExecResponse
+	for i := range c.AllOf {
+		ok, _, blockResp := c.AllOf[i].shouldHostScore(req, state, gip)
+		if !ok {
+			log.WithFields(log.Fields{
+				"block": i,
+			}).Debug("Did not match all_of block")
+			return false, blockResp
+		}
+		if blockResp != nil {
+			resp = blockResp
+		}
 	}
+	return true, resp
+}
 
-	if ok := c.authorizedJA3(req); !ok {
-		return false
+func (c *RequestConditions) anyOfMatch(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+	if len(c.AnyOf) == 0 {
+		return true, nil
 	}
 
-	if ok := c.authorizedExec(req); !ok {
-		return false
+	var resp *ExecResponse
+	for i := range c.AnyOf {
+		ok, _, blockResp := c.AnyOf[i].shouldHostScore(req, state, gip)
+		if ok {
+			log.WithFields(log.Fields{
+				"block": i,
+			}).Debug("Matched any_of block")
+			return true, blockResp
+		}
+		if blockResp != nil {
+			resp = blockResp
+		}
 	}
 
-	if ok := c.serveLimit(req, state); !ok {
-		return false
+	log.Debug("Did not match any any_of block")
+	return false, resp
+}
+
+// notMatch inverts the blocks, so their response overrides are dropped: an
+// allow override of a block must not be sent when the request is denied
+func (c *RequestConditions) notMatch(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+	for i := range c.Not {
+		if ok, _, _ := c.Not[i].shouldHostScore(req, state, gip); ok {
+			log.WithFields(log.Fields{
+				"block": i,
+			}).Debug("Matched not block")
+			return false, nil
+		}
 	}
+	return true, nil
+}
 
-	if ok := c.prereqMatch(req, state); !ok {
-		return false
+// matchFunc checks a condition. Conditions asking exec scripts and webhooks
+// may also return a response override. The override of a passing condition
+// applies only when the request is served, and the one of a failing condition
+// only when it is denied
+type matchFunc func(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse)
+
+// condition is a named check of ShouldHost. The name is the key used to weight it in scoring
+type condition struct {
+	name  string
+	match matchFunc
+	// set is true when the condition is configured. Conditions which aren't
+	// set always pass
+	set bool
+}
+
+func withRequest(f func(*http.Request) bool) matchFunc {
+	return func(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+		return f(req), nil
 	}
+}
 
-	if ok := c.geoipMatch(req, gip); !ok {
-		return false
+func withState(f func(*http.Request, *State) bool) matchFunc {
+	return func(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+		return f(req, state), nil
+	}
+}
+
+func withGeoIP(f func(*http.Request, geoip.DB) bool) matchFunc {
+	return func(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+		return f(req, gip), nil
 	}
+}
 
-	return true
+func withoutResponse(f func(*http.Request, *State, geoip.DB) bool) matchFunc {
+	return func(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+		return f(req, state, gip), nil
+	}
+}
+
+// conditions are the checks of ShouldHost in the order they run
+func (c *RequestConditions) conditions() []condition {
+	return []condition{
+		{"not_serving", withRequest(func(req *http.Request) bool {
+			if c.NotServing {
+				log.Trace("Not serving")
+				return false
+			}
+			return true
+		}), c.NotServing},
+		// Rate limits are counted by ShouldHostScore before any condition is
+		// checked, so every request counts, even ones failing the others
+		{"rate_limit", withState(c.rateLimit), len(c.RateLimit) > 0},
+		{"authorized_useragents", withRequest(c.authorizedUserAgents), len(c.AuthorizedUserAgents) > 0},
+		{"blacklist_useragents", withRequest(c.blacklistUserAgents), len(c.BlacklistUserAgents) > 0},
+		{"authorized_useragents_glob", withRequest(c.authorizedUserAgentsGlob), len(c.AuthorizedUserAgentsGlob) > 0},
+		{"blacklist_useragents_glob", withRequest(c.blacklistUserAgentsGlob), len(c.BlacklistUserAgentsGlob) > 0},
+		{"authorized_languages", withRequest(c.authorizedLanguages), len(c.AuthorizedLanguages) > 0},
+		{"blacklist_languages", withRequest(c.blacklistLanguages), len(c.BlacklistLanguages) > 0},
+		{"authorized_referers", withRequest(c.authorizedReferers), len(c.AuthorizedReferers) > 0 || len(c.AuthorizedReferersGlob) > 0},
+		{"blacklist_referers", withRequest(c.blacklistReferers), len(c.BlacklistReferers) > 0 || len(c.BlacklistReferersGlob) > 0},
+		{"authorized_hosts", withRequest(c.authorizedHosts), len(c.AuthorizedHosts) > 0},
+		{"blacklist_hosts", withRequest(c.blacklistHosts), len(c.BlacklistHosts) > 0},
+		{"authorized_iprange", withRequest(c.authorizedIPRange), len(c.AuthorizedIPRange) > 0},
+		{"blacklist_iprange", withRequest(c.blacklistIPRange), len(c.BlacklistIPRange) > 0},
+		{"authorized_methods", withRequest(c.authorizedMethods), len(c.AuthorizedMethods) > 0},
+		{"authorized_headers", withRequest(c.authorizedHeaders), len(c.AuthorizedHeaders) > 0 || len(c.AuthorizedHeadersRegex) > 0 || len(c.AuthorizedHeadersGlob) > 0},
+		{"forbidden_headers", withRequest(c.forbiddenHeaders), len(c.ForbiddenHeaders) > 0},
+		{"authorized_query", withRequest(c.authorizedQuery), len(c.AuthorizedQuery) > 0},
+		{"blacklist_query", withRequest(c.blacklistQuery), len(c.BlacklistQuery) > 0},
+		{"authorized_cookies", withRequest(c.authorizedCookies), len(c.AuthorizedCookies) > 0},
+		{"blacklist_cookies", withRequest(c.blacklistCookies), len(c.BlacklistCookies) > 0},
+		{"authorized_ja3", withRequest(c.authorizedJA3), len(c.AuthorizedJA3) > 0},
+		{"blacklist_ja3", withRequest(c.blacklistJA3), len(c.BlacklistJA3) > 0},
+		{"authorized_ja3_glob", withRequest(c.authorizedJA3Glob), len(c.AuthorizedJA3Glob) > 0},
+		{"blacklist_ja3_glob", withRequest(c.blacklistJA3Glob), len(c.BlacklistJA3Glob) > 0},
+		{"authorized_ja4", withRequest(c.authorizedJA4), len(c.AuthorizedJA4) > 0},
+		{"blacklist_ja4", withRequest(c.blacklistJA4), len(c.BlacklistJA4) > 0},
+		{"authorized_ja4h", withRequest(c.authorizedJA4H), len(c.AuthorizedJA4H) > 0},
+		{"blacklist_ja4h", withRequest(c.blacklistJA4H), len(c.BlacklistJA4H) > 0},
+		{"authorized_sni", withRequest(c.authorizedSNI), len(c.AuthorizedSNI) > 0},
+		{"min_tls_version", withRequest(c.minTLSVersion), c.MinTLSVersion != ""},
+		{"required_alpn", withRequest(c.requiredALPN), len(c.RequiredALPN) > 0},
+		{"authorized_ciphers", withRequest(c.authorizedCiphers), len(c.AuthorizedCiphers) > 0},
+		{"blacklist_ciphers", withRequest(c.blacklistCiphers), len(c.BlacklistCiphers) > 0},
+		{"require_sni_match", withRequest(c.sniMatch), c.RequireSNIMatch},
+		{"body", withRequest(c.bodyMatch), len(c.BodyRegex) > 0 || len(c.BodyJSONPath) > 0 || len(c.FormField) > 0},
+		{"exec", c.authorizedExec, c.Exec.ScriptPath != ""},
+		{"webhook", c.webhookMatch, c.Webhook.URL != ""},
+		{"script", withoutResponse(c.scriptMatch), c.Script != ""},
+		{"serve", withState(c.serveLimit), c.Serve != 0},
+		{"serve_per_client", withState(c.clientServeLimits), c.ServePerIP != 0 || c.ServePerSession != 0 || c.ServePerJA3 != 0},
+		{"prereq", withState(c.prereqMatch), len(c.PrereqPaths) > 0},
+		{"geoip", withGeoIP(c.geoipMatch), len(c.GeoIP.AuthorizedCountries) > 0 || len(c.GeoIP.BlacklistCountries) > 0},
+		{"geoip_location", withGeoIP(c.geoLocationMatch), len(c.GeoIP.AuthorizedRegions) > 0 || len(c.GeoIP.BlacklistRegions) > 0 || len(c.GeoIP.AuthorizedCities) > 0 || len(c.GeoIP.BlacklistCities) > 0 || len(c.GeoIP.Geofence) > 0},
+		{"asn", withGeoIP(c.asnMatch), len(c.AuthorizedASN) > 0 || len(c.BlacklistASN) > 0 || len(c.AuthorizedASNOrg) > 0 || len(c.BlacklistASNOrg) > 0},
+		{"authorized_rdns_glob", withState(c.authorizedRDNSGlob), len(c.AuthorizedRDNSGlob) > 0},
+		{"blacklist_rdns_glob", withState(c.blacklistRDNSGlob), len(c.BlacklistRDNSGlob) > 0},
+		{"time", withRequest(c.timeRange), c.NotBefore != "" || c.NotAfter != ""},
+		{"schedule", withGeoIP(c.scheduleMatch), len(c.Schedule) > 0},
+		{"all_of", c.allOfMatch, len(c.AllOf) > 0},
+		{"any_of", c.anyOfMatch, len(c.AnyOf) > 0},
+		{"not", c.notMatch, len(c.Not) > 0},
+	}
+}
+
+// ShouldHost returns when an HTTP request should be hosted or not
+func (c *RequestConditions) ShouldHost(req *http.Request, state *State, gip geoip.DB) bool {
+	ok, _, _ := c.ShouldHostScore(req, state, gip)
+	return ok
 }
@@ -7,10 +7,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/t94j0/array"
 	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
 	"github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/geoip/geoiptest"
 
 	. "github.com/t94j0/satellite/satellite/path"
 )
@@ -569,6 +572,168 @@ authorized_iprange:
 	}
 }
 
+func TestRequestConditions_ShouldHost_ipv6_auth_succeed(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "[2001:db8::1]:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+authorized_iprange:
+  - 2001:db8::1
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ipv6_auth_cidr_succeed(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "[2001:db8:0:1::25]:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+authorized_iprange:
+  - 2001:db8::/32
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ipv6_auth_cidr_fail(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "[2001:db9::1]:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+authorized_iprange:
+  - 2001:db8::/32
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ipv6_auth_zone_succeed(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "[fe80::1%eth0]:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+authorized_iprange:
+  - fe80::/10
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ipv6_bl_cidr(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "[2001:db8::1]:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+blacklist_iprange:
+  - 2001:db8::/32
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ipv6_bl_succeed(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "[2001:db8::1]:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+blacklist_iprange:
+  - 2001:db9::/32
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestRequestConditions_ShouldHost_ip_bl_succeed(t *testing.T) {
 	// Create HTTP Request
 	mockRequest := &http.Request{RemoteAddr: "127.0.0.1:54321"}
@@ -784,53 +949,58 @@ authorized_headers:
 	}
 }
 
-func TestRequestConditions_ShouldHost_ja3(t *testing.T) {
-	// TODO: Add tests for JA3
-
-}
-
-func TestRequestConditions_ShouldHost_exec_succeed(t *testing.T) {
-	// Create HTTP Request
+func TestRequestConditions_ShouldHost_ja3_succeed(t *testing.T) {
 	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,0-23-65281-10-11,29-23-24,0"
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	// Add script
-	data := "#!/usr/bin/env python\nprint('ok')"
-	shellfile, err := ioutil.TempFile("", "file")
+	data := `
+authorized_ja3:
+  - 48618013a8b07e58698ab1c0112f1bae
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	defer os.Remove(shellfile.Name())
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
 
-	if _, err := shellfile.Write([]byte(data)); err != nil {
+	if err := RemoveDB(file); err != nil {
 		t.Error(err)
 	}
+}
 
-	if err := shellfile.Chmod(0777); err != nil {
+func TestRequestConditions_ShouldHost_ja3_fail(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,0-23-65281-10-11,29-23-24,0"
 
-	if err := shellfile.Close(); err != nil {
+	state, file, err := TemporaryDB()
+	if err != nil {
 		t.Error(err)
 	}
 
-	// Execute
-	content := "exec:\n"
-	content += fmt.Sprintf("  script: %s\n", shellfile.Name())
-	content += "  output: ok"
+	data := `
+authorized_ja3:
+  - d41d8cd98f00b204e9800998ecf8427e
+`
 
-	conditions, err := NewRequestConditions([]byte(content))
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -839,48 +1009,58 @@ func TestRequestConditions_ShouldHost_exec_succeed(t *testing.T) {
 	}
 }
 
-func TestRequestConditions_ShouldHost_exec_fail(t *testing.T) {
-	// Create HTTP Request
+func TestRequestConditions_ShouldHost_ja3_blacklist(t *testing.T) {
 	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,0-23-65281-10-11,29-23-24,0"
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	// Add script
-	data := "#!/usr/bin/env python\nprint('not_ok')"
-	shellfile, err := ioutil.TempFile("", "file")
+	data := `
+blacklist_ja3:
+  - 48618013a8b07e58698ab1c0112f1bae
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	defer os.Remove(shellfile.Name())
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
 
-	if _, err := shellfile.Write([]byte(data)); err != nil {
+	if err := RemoveDB(file); err != nil {
 		t.Error(err)
 	}
+}
 
-	if err := shellfile.Chmod(0777); err != nil {
+func TestRequestConditions_ShouldHost_ja3_glob_succeed(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,0-23-65281-10-11,29-23-24,0"
 
-	if err := shellfile.Close(); err != nil {
+	state, file, err := TemporaryDB()
+	if err != nil {
 		t.Error(err)
 	}
 
-	// Execute
-	content := "exec:\n"
-	content += fmt.Sprintf("  script: %s\n", shellfile.Name())
-	content += "  output: ok"
+	data := `
+authorized_ja3_glob:
+  - "771,*,29-23-24,0"
+`
 
-	conditions, err := NewRequestConditions([]byte(content))
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -889,21 +1069,22 @@ func TestRequestConditions_ShouldHost_exec_fail(t *testing.T) {
 	}
 }
 
-func TestRequestConditions_ShouldHost_notserving(t *testing.T) {
-	// Create HTTP Request
+func TestRequestConditions_ShouldHost_ja3_glob_blacklist(t *testing.T) {
 	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,0-23-65281-10-11,29-23-24,0"
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	// Create RequestConditions object
 	data := `
-not_serving: true`
+blacklist_ja3_glob:
+  - "*,0-23-65281-*"
+`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
@@ -918,21 +1099,23 @@ not_serving: true`
 	}
 }
 
-func TestRequestConditions_ShouldHost_serve_one_succeed(t *testing.T) {
-	// Create HTTP Request
+func TestRequestConditions_ShouldHost_ja3_normalized_succeed(t *testing.T) {
 	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,65281-0-11-23-10,29-23-24,0"
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	// Create RequestConditions object
 	data := `
-serve: 1`
+ja3_normalized: true
+authorized_ja3:
+  - 9b2b4a5bec5a726cb63ea6351f98b813
+`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
@@ -947,25 +1130,22 @@ serve: 1`
 	}
 }
 
-func TestRequestConditions_ShouldHost_serve_one_fail(t *testing.T) {
-	// Create HTTP Request
+func TestRequestConditions_ShouldHost_ja3_normalized_fail(t *testing.T) {
 	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA3Fingerprint = "771,4865-4866-4867,65281-0-11-23-10,29-23-24,0"
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	if err := state.Hit(mockRequest); err != nil {
-		t.Error(err)
-	}
-
-	// Create RequestConditions object
 	data := `
-serve: 1`
+authorized_ja3:
+  - 9b2b4a5bec5a726cb63ea6351f98b813
+`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
@@ -980,25 +1160,31 @@ serve: 1`
 	}
 }
 
-func TestRequestConditions_ShouldHost_prereq_none(t *testing.T) {
-	// Create HTTP Request
+func TestNormalizeJA3(t *testing.T) {
+	if NormalizeJA3("771,4865-4866-4867,65281-0-11-23-10,29-23-24,0") != "771,4865-4866-4867,0-10-11-23-65281,29-23-24,0" {
+		t.Fail()
+	}
+	if NormalizeJA3("") != "" {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_ja4_succeed(t *testing.T) {
 	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA4Fingerprint = "t13d1516h2_8daaf6152771_e5627efa2ab1"
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	if err := state.Hit(mockRequest); err != nil {
-		t.Error(err)
-	}
-
-	// Create RequestConditions object
 	data := `
-prereq:`
+authorized_ja4:
+  - t13d1516h2_8daaf6152771_e5627efa2ab1
+`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
@@ -1013,36 +1199,58 @@ prereq:`
 	}
 }
 
-func TestRequestConditions_ShouldHost_prereq_one_succeed(t *testing.T) {
-	state, file, err := TemporaryDB()
+func TestRequestConditions_ShouldHost_ja4_fail(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA4Fingerprint = "t13d1516h2_8daaf6152771_e5627efa2ab1"
 
-	firstHit, err := http.NewRequest("GET", "/", nil)
+	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	payloadHit, err := http.NewRequest("GET", "/payload", nil)
+	data := `
+authorized_ja4:
+  - t13d1516h2_000000000000_000000000000
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-
-	if err := state.Hit(firstHit); err != nil {
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ja4_blacklist(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	mockRequest.JA4Fingerprint = "t13d1516h2_8daaf6152771_e5627efa2ab1"
+
+	state, file, err := TemporaryDB()
+	if err != nil {
 		t.Error(err)
 	}
 
-	// Create RequestConditions object
 	data := `
-prereq:
-  - /`
+blacklist_ja4:
+  - t13d1516h2_8daaf6152771_e5627efa2ab1
+`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if !conditions.ShouldHost(payloadHit, state, geoip.DB{}) {
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -1051,36 +1259,58 @@ prereq:
 	}
 }
 
-func TestRequestConditions_ShouldHost_prereq_one_fail(t *testing.T) {
+func TestRequestConditions_ShouldHost_ja4h_succeed(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	mockRequest.JA4HFingerprint = "ge11nn05enus_9ed1ff1f7b03_000000000000_000000000000"
+
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	firstHit, err := http.NewRequest("GET", "/one", nil)
+	data := `
+authorized_ja4h:
+  - ge11nn05enus_9ed1ff1f7b03_000000000000_000000000000
+`
+
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
 
-	payloadHit, err := http.NewRequest("GET", "/two", nil)
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_ja4h_blacklist(t *testing.T) {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Error(err)
 	}
+	mockRequest.JA4HFingerprint = "ge11nn05enus_9ed1ff1f7b03_000000000000_000000000000"
 
-	if err := state.Hit(firstHit); err != nil {
+	state, file, err := TemporaryDB()
+	if err != nil {
 		t.Error(err)
 	}
 
-	// Create RequestConditions object
 	data := `
-prereq:
-  - /`
+blacklist_ja4h:
+  - ge11nn05enus_9ed1ff1f7b03_000000000000_000000000000
+`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if conditions.ShouldHost(payloadHit, state, geoip.DB{}) {
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -1089,46 +1319,98 @@ prereq:
 	}
 }
 
-func createGeoIP() (geoip.DB, error) {
-	wd, err := os.Getwd()
+func TestRequestConditions_ShouldHost_exec_succeed(t *testing.T) {
+	// Create HTTP Request
+	mockRequest, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
-		return geoip.DB{}, err
+		t.Error(err)
 	}
 
-	fp := filepath.Join(wd, "..", "..", ".config", "var", "lib", "satellite", "GeoLite2-Country.mmdb")
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
 
-	gip, err := geoip.New(fp)
+	// Add script
+	data := "#!/usr/bin/env python\nprint('ok')"
+	shellfile, err := ioutil.TempFile("", "file")
 	if err != nil {
-		return geoip.DB{}, err
+		t.Error(err)
+	}
+	defer os.Remove(shellfile.Name())
+
+	if _, err := shellfile.Write([]byte(data)); err != nil {
+		t.Error(err)
 	}
 
-	return gip, nil
+	if err := shellfile.Chmod(0777); err != nil {
+		t.Error(err)
+	}
+
+	if err := shellfile.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Execute
+	content := "exec:\n"
+	content += fmt.Sprintf("  script: %s\n", shellfile.Name())
+	content += "  output: ok"
+
+	conditions, err := NewRequestConditions([]byte(content))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestRequestConditions_ShouldHost_geoip_success(t *testing.T) {
+func TestRequestConditions_ShouldHost_exec_fail(t *testing.T) {
 	// Create HTTP Request
-	mockRequest := &http.Request{RemoteAddr: "72.229.28.185:54321"}
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	gip, err := createGeoIP()
+	// Add script
+	data := "#!/usr/bin/env python\nprint('not_ok')"
+	shellfile, err := ioutil.TempFile("", "file")
 	if err != nil {
 		t.Error(err)
 	}
+	defer os.Remove(shellfile.Name())
 
-	data := `
-geoip:
-  authorized_countries:
-    - US`
+	if _, err := shellfile.Write([]byte(data)); err != nil {
+		t.Error(err)
+	}
 
-	conditions, err := NewRequestConditions([]byte(data))
+	if err := shellfile.Chmod(0777); err != nil {
+		t.Error(err)
+	}
+
+	if err := shellfile.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Execute
+	content := "exec:\n"
+	content += fmt.Sprintf("  script: %s\n", shellfile.Name())
+	content += "  output: ok"
+
+	conditions, err := NewRequestConditions([]byte(content))
 	if err != nil {
 		t.Error(err)
 	}
-	if !conditions.ShouldHost(mockRequest, state, gip) {
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -1137,29 +1419,56 @@ geoip:
 	}
 }
 
-func TestRequestConditions_ShouldHost_geoip_failure(t *testing.T) {
+func TestRequestConditions_ShouldHost_notserving(t *testing.T) {
 	// Create HTTP Request
-	mockRequest := &http.Request{RemoteAddr: "72.229.28.185:54321"}
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	gip, err := createGeoIP()
+	// Create RequestConditions object
+	data := `
+not_serving: true`
+
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
 
-	data := `geoip:
-  authorized_countries:
-    - EU`
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_one_succeed(t *testing.T) {
+	// Create HTTP Request
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Create RequestConditions object
+	data := `
+serve: 1`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if conditions.ShouldHost(mockRequest, state, gip) {
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -1168,29 +1477,31 @@ func TestRequestConditions_ShouldHost_geoip_failure(t *testing.T) {
 	}
 }
 
-func TestRequestConditions_ShouldHost_geoip_blacklist(t *testing.T) {
+func TestRequestConditions_ShouldHost_serve_one_fail(t *testing.T) {
 	// Create HTTP Request
-	mockRequest := &http.Request{RemoteAddr: "72.229.28.185:54321"}
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	gip, err := createGeoIP()
-	if err != nil {
+	if err := state.Hit(mockRequest); err != nil {
 		t.Error(err)
 	}
 
-	data := `geoip:
-  blacklist_countries:
-    - US`
+	// Create RequestConditions object
+	data := `
+serve: 1`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if conditions.ShouldHost(mockRequest, state, gip) {
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -1199,29 +1510,69 @@ func TestRequestConditions_ShouldHost_geoip_blacklist(t *testing.T) {
 	}
 }
 
-func TestRequestConditions_ShouldHost_geoip_blacklist_accept(t *testing.T) {
+func TestRequestConditions_ShouldHost_prereq_none(t *testing.T) {
 	// Create HTTP Request
-	mockRequest := &http.Request{RemoteAddr: "5.250.176.20:54321"}
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
 
 	state, file, err := TemporaryDB()
 	if err != nil {
 		t.Error(err)
 	}
 
-	gip, err := createGeoIP()
+	if err := state.Hit(mockRequest); err != nil {
+		t.Error(err)
+	}
+
+	// Create RequestConditions object
+	data := `
+prereq:`
+
+	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
 
-	data := `geoip:
-  blacklist_countries:
-    - US`
+func TestRequestConditions_ShouldHost_prereq_one_succeed(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	firstHit, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	payloadHit, err := http.NewRequest("GET", "/payload", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := state.Hit(firstHit); err != nil {
+		t.Error(err)
+	}
+
+	// Create RequestConditions object
+	data := `
+prereq:
+  - /`
 
 	conditions, err := NewRequestConditions([]byte(data))
 	if err != nil {
 		t.Error(err)
 	}
-	if !conditions.ShouldHost(mockRequest, state, gip) {
+	if !conditions.ShouldHost(payloadHit, state, geoip.DB{}) {
 		t.Fail()
 	}
 
@@ -1229,3 +1580,993 @@ func TestRequestConditions_ShouldHost_geoip_blacklist_accept(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRequestConditions_ShouldHost_prereq_ipv6(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	firstHit := httptest.NewRequest("GET", "/", nil)
+	firstHit.RemoteAddr = "[2001:db8::1]:54321"
+	otherHit := httptest.NewRequest("GET", "/payload", nil)
+	otherHit.RemoteAddr = "[2001:db8::2]:54321"
+	payloadHit := httptest.NewRequest("GET", "/payload", nil)
+	payloadHit.RemoteAddr = "[2001:db8:0::1]:12345"
+
+	if err := state.Hit(firstHit); err != nil {
+		t.Error(err)
+	}
+
+	data := `
+prereq:
+  - /`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(otherHit, state, geoip.DB{}) {
+		t.Fail()
+	}
+	if !conditions.ShouldHost(payloadHit, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_one_fail(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	firstHit, err := http.NewRequest("GET", "/one", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	payloadHit, err := http.NewRequest("GET", "/two", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := state.Hit(firstHit); err != nil {
+		t.Error(err)
+	}
+
+	// Create RequestConditions object
+	data := `
+prereq:
+  - /`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(payloadHit, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func createGeoIP() (geoip.DB, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return geoip.DB{}, err
+	}
+
+	fp := filepath.Join(wd, "..", "..", ".config", "var", "lib", "satellite", "GeoLite2-Country.mmdb")
+
+	gip, err := geoip.New(fp)
+	if err != nil {
+		return geoip.DB{}, err
+	}
+
+	return gip, nil
+}
+
+func TestRequestConditions_ShouldHost_geoip_success(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "72.229.28.185:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	gip, err := createGeoIP()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+geoip:
+  authorized_countries:
+    - US`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, gip) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_geoip_failure(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "72.229.28.185:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	gip, err := createGeoIP()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `geoip:
+  authorized_countries:
+    - EU`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, gip) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_geoip_blacklist(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "72.229.28.185:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	gip, err := createGeoIP()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `geoip:
+  blacklist_countries:
+    - US`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, gip) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_geoip_blacklist_accept(t *testing.T) {
+	// Create HTTP Request
+	mockRequest := &http.Request{RemoteAddr: "5.250.176.20:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	gip, err := createGeoIP()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `geoip:
+  blacklist_countries:
+    - US`
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, gip) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_any_of_succeed(t *testing.T) {
+	header := http.Header(make(map[string][]string))
+	header.Add("User-Agent", "none")
+	mockRequest := &http.Request{Header: header, RemoteAddr: "10.8.0.5:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+any_of:
+  - authorized_useragents:
+    - notthisone
+  - authorized_iprange:
+    - 10.8.0.0/16
+`
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_any_of_fail(t *testing.T) {
+	header := http.Header(make(map[string][]string))
+	header.Add("User-Agent", "none")
+	mockRequest := &http.Request{Header: header, RemoteAddr: "192.168.0.5:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+any_of:
+  - authorized_useragents:
+    - notthisone
+  - authorized_iprange:
+    - 10.8.0.0/16
+`
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_all_of_fail(t *testing.T) {
+	header := http.Header(make(map[string][]string))
+	header.Add("User-Agent", "none")
+	mockRequest := &http.Request{Header: header, RemoteAddr: "10.8.0.5:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+all_of:
+  - authorized_useragents:
+    - none
+  - authorized_iprange:
+    - 192.168.0.0/16
+`
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_not_fail(t *testing.T) {
+	header := http.Header(make(map[string][]string))
+	header.Add("User-Agent", "none")
+	mockRequest := &http.Request{Header: header, RemoteAddr: "10.8.0.5:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+authorized_useragents:
+  - none
+not:
+  - authorized_iprange:
+    - 10.8.0.0/16
+`
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_ShouldHost_nested_succeed(t *testing.T) {
+	header := http.Header(make(map[string][]string))
+	header.Add("User-Agent", "none")
+	mockRequest := &http.Request{Header: header, RemoteAddr: "10.8.0.5:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := `
+any_of:
+  - authorized_useragents:
+    - notthisone
+  - all_of:
+    - authorized_useragents:
+      - none
+    not:
+    - authorized_iprange:
+      - 192.168.0.0/16
+`
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !conditions.ShouldHost(mockRequest, state, geoip.DB{}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestConditions_NewRequestConditions_nested_fail(t *testing.T) {
+	data := `
+any_of:
+  - not:
+    - authorized_useragents:
+      - '[a-z'
+`
+	if _, err := NewRequestConditions([]byte(data)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestMergeRequestConditions_blocks(t *testing.T) {
+	rq1 := RequestConditions{
+		AnyOf: []RequestConditions{{AuthorizedUserAgents: []string{"SENTINAL1"}}},
+	}
+	rq2 := RequestConditions{
+		AnyOf: []RequestConditions{{AuthorizedUserAgents: []string{"SENTINAL2"}}},
+		Not:   []RequestConditions{{AuthorizedMethods: []string{"POST"}}},
+	}
+
+	rq, err := MergeRequestConditions(rq1, rq2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(rq.AnyOf) != 2 || len(rq.Not) != 1 {
+		t.Fail()
+	}
+
+	if len(rq.AnyOf[0].AuthorizedUserAgents) != 1 || len(rq.AnyOf[1].AuthorizedUserAgents) != 1 {
+		t.Fail()
+	}
+}
+
+func shouldHostAt(t *testing.T, data string) bool {
+	mockRequest, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	mockRequest.RemoteAddr = "127.0.0.1:54321"
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, geoip.DB{})
+}
+
+func TestRequestConditions_ShouldHost_not_before_succeed(t *testing.T) {
+	data := fmt.Sprintf("not_before: %s", time.Now().Add(-time.Hour).Format(time.RFC3339))
+	if !shouldHostAt(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_not_before_fail(t *testing.T) {
+	data := fmt.Sprintf("not_before: %s", time.Now().Add(time.Hour).Format(time.RFC3339))
+	if shouldHostAt(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_not_after_fail(t *testing.T) {
+	data := fmt.Sprintf("not_after: %s", time.Now().Add(-time.Hour).Format(time.RFC3339))
+	if shouldHostAt(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_schedule_succeed(t *testing.T) {
+	n := time.Now().In(time.UTC)
+	data := fmt.Sprintf(`
+schedule:
+  - days: [%s, %s]
+    start: "%s"
+    end: "%s"
+`, n.Format("Mon"), n.AddDate(0, 0, -1).Format("Mon"), n.Add(-time.Hour).Format("15:04"), n.Add(time.Hour).Format("15:04"))
+	if !shouldHostAt(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_schedule_fail(t *testing.T) {
+	n := time.Now().In(time.UTC)
+	data := fmt.Sprintf(`
+schedule:
+  - start: "%s"
+    end: "%s"
+    timezone: UTC
+`, n.Add(time.Hour).Format("15:04"), n.Add(2*time.Hour).Format("15:04"))
+	if shouldHostAt(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_schedule_client_nodb(t *testing.T) {
+	data := `
+schedule:
+  - start: "00:00"
+    end: "00:00"
+    timezone: client
+`
+	if shouldHostAt(t, data) {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_schedule_badtimezone(t *testing.T) {
+	data := `
+schedule:
+  - start: "08:00"
+    end: "18:00"
+    timezone: Mars/Olympus_Mons
+`
+	if _, err := NewRequestConditions([]byte(data)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_schedule_badday(t *testing.T) {
+	data := `
+schedule:
+  - days: [someday]
+    start: "08:00"
+    end: "18:00"
+`
+	if _, err := NewRequestConditions([]byte(data)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_not_after_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("not_after: tomorrow")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestTimeWindow_Contains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	w := TimeWindow{Days: []string{"weekdays"}, Start: "08:00", End: "18:00"}
+
+	// Friday 2019-11-22 16:30 UTC is 17:30 in Berlin
+	if !w.Contains(time.Date(2019, 11, 22, 16, 30, 0, 0, time.UTC), berlin) {
+		t.Error("expected Friday 17:30 Berlin to be open")
+	}
+	// 17:30 UTC is 18:30 in Berlin
+	if w.Contains(time.Date(2019, 11, 22, 17, 30, 0, 0, time.UTC), berlin) {
+		t.Error("expected Friday 18:30 Berlin to be closed")
+	}
+	// Saturday
+	if w.Contains(time.Date(2019, 11, 23, 10, 0, 0, 0, time.UTC), berlin) {
+		t.Error("expected Saturday to be closed")
+	}
+}
+
+func TestTimeWindow_Contains_overnight(t *testing.T) {
+	w := TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}
+
+	// Saturday 02:00 is still part of Friday night
+	if !w.Contains(time.Date(2019, 11, 23, 2, 0, 0, 0, time.UTC), time.UTC) {
+		t.Error("expected Saturday 02:00 to be open")
+	}
+	// Friday 02:00 belongs to Thursday night
+	if w.Contains(time.Date(2019, 11, 22, 2, 0, 0, 0, time.UTC), time.UTC) {
+		t.Error("expected Friday 02:00 to be closed")
+	}
+}
+
+func asnDB(t *testing.T) geoip.DB {
+	dir, err := ioutil.TempDir("", "satelliteasn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	if err := geoiptest.WriteDB(fp, "GeoLite2-ASN", []geoiptest.Network{
+		{CIDR: "8.8.8.0/24", Record: map[string]interface{}{
+			"autonomous_system_number":       uint32(15169),
+			"autonomous_system_organization": "Google LLC",
+		}},
+		{CIDR: "198.51.100.0/24", Record: map[string]interface{}{
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example Sandbox Hosting",
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var gip geoip.DB
+	if err := gip.OpenASN(fp); err != nil {
+		t.Fatal(err)
+	}
+	return gip
+}
+
+func shouldHostASN(t *testing.T, remoteAddr, data string) bool {
+	mockRequest := &http.Request{RemoteAddr: remoteAddr}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, asnDB(t))
+}
+
+func TestRequestConditions_ShouldHost_asn_auth_succeed(t *testing.T) {
+	if !shouldHostASN(t, "8.8.8.8:54321", "authorized_asn: [AS15169]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_asn_auth_fail(t *testing.T) {
+	if shouldHostASN(t, "198.51.100.7:54321", "authorized_asn: [15169]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_asn_bl(t *testing.T) {
+	if shouldHostASN(t, "8.8.8.8:54321", "blacklist_asn: [AS15169]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_asn_bl_succeed(t *testing.T) {
+	if !shouldHostASN(t, "198.51.100.7:54321", "blacklist_asn: [AS15169]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_asn_org_auth_succeed(t *testing.T) {
+	if !shouldHostASN(t, "8.8.8.8:54321", "authorized_asn_org: ['^Google']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_asn_org_bl(t *testing.T) {
+	if shouldHostASN(t, "198.51.100.7:54321", "blacklist_asn_org: ['(?i)sandbox']") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_asn_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("authorized_asn: [ASabc]")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseASN(t *testing.T) {
+	for _, asn := range []string{"15169", "AS15169", "as15169"} {
+		if n, err := ParseASN(asn); err != nil || n != 15169 {
+			t.Error(asn, n, err)
+		}
+	}
+}
+
+func cityDB(t *testing.T) geoip.DB {
+	dir, err := ioutil.TempDir("", "satellitecity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "GeoLite2-City.mmdb")
+	if err := geoiptest.WriteDB(fp, "GeoLite2-City", []geoiptest.Network{
+		{CIDR: "203.0.113.0/24", Record: map[string]interface{}{
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Berlin"}},
+			"country": map[string]interface{}{"iso_code": "DE"},
+			"location": map[string]interface{}{
+				"latitude":  52.52,
+				"longitude": 13.405,
+				"time_zone": "Europe/Berlin",
+			},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "BE"}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	gip, err := geoip.New(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gip
+}
+
+func shouldHostCity(t *testing.T, data string) bool {
+	mockRequest := &http.Request{RemoteAddr: "203.0.113.9:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, cityDB(t))
+}
+
+func TestRequestConditions_ShouldHost_region_succeed(t *testing.T) {
+	if !shouldHostCity(t, "geoip:\n  authorized_regions: [DE-BE]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_region_fail(t *testing.T) {
+	if shouldHostCity(t, "geoip:\n  authorized_regions: [US-CA]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_region_bl(t *testing.T) {
+	if shouldHostCity(t, "geoip:\n  blacklist_regions: [de-be]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_city_succeed(t *testing.T) {
+	if !shouldHostCity(t, "geoip:\n  authorized_cities: [berlin]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_city_bl(t *testing.T) {
+	if shouldHostCity(t, "geoip:\n  blacklist_cities: [Berlin]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_geofence_succeed(t *testing.T) {
+	// Potsdam is about 27km from Berlin
+	data := `
+geoip:
+  geofence:
+    - latitude: 52.3906
+      longitude: 13.0645
+      radius_km: 50
+`
+	if !shouldHostCity(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_geofence_fail(t *testing.T) {
+	data := `
+geoip:
+  geofence:
+    - latitude: 52.3906
+      longitude: 13.0645
+      radius_km: 10
+`
+	if shouldHostCity(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_region_country_db(t *testing.T) {
+	mockRequest := &http.Request{RemoteAddr: "203.0.113.9:54321"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	gip, err := createGeoIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions, err := NewRequestConditions([]byte("geoip:\n  authorized_regions: [US-CA]"))
+	if err != nil {
+		t.Error(err)
+	}
+	// Country databases have no regions, so the condition is skipped
+	if !conditions.ShouldHost(mockRequest, state, gip) {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_geofence_bad(t *testing.T) {
+	data := `
+geoip:
+  geofence:
+    - latitude: 95
+      longitude: 13
+      radius_km: 10
+`
+	if _, err := NewRequestConditions([]byte(data)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_schedule_client(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	n := time.Now().In(berlin)
+	data := fmt.Sprintf(`
+schedule:
+  - start: "%s"
+    end: "%s"
+    timezone: client
+`, n.Add(-time.Hour).Format("15:04"), n.Add(time.Hour).Format("15:04"))
+	if !shouldHostCity(t, data) {
+		t.Fail()
+	}
+}
+
+func shouldHostHeaders(t *testing.T, header http.Header, data string) bool {
+	mockRequest := &http.Request{Header: header, Host: "example.com"}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, geoip.DB{})
+}
+
+func TestRequestConditions_ShouldHost_header_regex_succeed(t *testing.T) {
+	header := http.Header{"Accept-Language": {"en-US,en;q=0.9"}}
+	if !shouldHostHeaders(t, header, "authorized_headers_regex:\n  Accept-Language: '^en-'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_regex_fail(t *testing.T) {
+	header := http.Header{"Accept-Language": {"de-DE"}}
+	if shouldHostHeaders(t, header, "authorized_headers_regex:\n  Accept-Language: '^en-'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_glob_succeed(t *testing.T) {
+	header := http.Header{"Accept": {"text/html,application/xhtml+xml"}}
+	if !shouldHostHeaders(t, header, "authorized_headers_glob:\n  accept: 'text/html*'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_multivalue(t *testing.T) {
+	header := http.Header{"X-Token": {"first", "second"}}
+	if !shouldHostHeaders(t, header, "authorized_headers:\n  X-Token: second") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_host(t *testing.T) {
+	if !shouldHostHeaders(t, http.Header{}, "authorized_headers_glob:\n  Host: '*.com'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_any(t *testing.T) {
+	header := http.Header{"Header": {"test"}}
+	data := `
+authorized_headers:
+  Header: test
+authorized_headers_regex:
+  Other: '.*'
+`
+	if !shouldHostHeaders(t, header, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_require_all_fail(t *testing.T) {
+	header := http.Header{"Header": {"test"}}
+	data := `
+headers_require_all: true
+authorized_headers:
+  Header: test
+authorized_headers_regex:
+  Other: '.*'
+`
+	if shouldHostHeaders(t, header, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_header_require_all_succeed(t *testing.T) {
+	header := http.Header{"Header": {"test"}, "Other": {"value"}}
+	data := `
+headers_require_all: true
+authorized_headers:
+  Header: test
+authorized_headers_regex:
+  Other: '.*'
+`
+	if !shouldHostHeaders(t, header, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_forbidden_headers(t *testing.T) {
+	header := http.Header{"Via": {"1.1 proxy"}}
+	if shouldHostHeaders(t, header, "forbidden_headers: [X-Scanner, via]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_forbidden_headers_absent(t *testing.T) {
+	header := http.Header{"Accept": {"*/*"}}
+	if !shouldHostHeaders(t, header, "forbidden_headers: [X-Scanner, Via]") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_header_regex_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("authorized_headers_regex:\n  Accept: '('")); err == nil {
+		t.Fail()
+	}
+}
+
+func shouldHostURL(t *testing.T, target string, cookies []*http.Cookie, data string) bool {
+	mockRequest := httptest.NewRequest("GET", target, nil)
+	for _, cookie := range cookies {
+		mockRequest.AddCookie(cookie)
+	}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, geoip.DB{})
+}
+
+func TestRequestConditions_ShouldHost_query_succeed(t *testing.T) {
+	if !shouldHostURL(t, "/payload?rid=a1b2c3", nil, "authorized_query:\n  rid: '^[a-z0-9]{6}$'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_query_fail(t *testing.T) {
+	if shouldHostURL(t, "/payload?rid=nope", nil, "authorized_query:\n  rid: '^[a-z0-9]{6}$'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_query_missing(t *testing.T) {
+	if shouldHostURL(t, "/payload", nil, "authorized_query:\n  rid: '.*'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_query_all(t *testing.T) {
+	data := `
+authorized_query:
+  rid: '^a1b2c3$'
+  campaign: '^q3$'
+`
+	if shouldHostURL(t, "/payload?rid=a1b2c3", nil, data) {
+		t.Fail()
+	}
+	if !shouldHostURL(t, "/payload?rid=a1b2c3&campaign=q3", nil, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_query_bl(t *testing.T) {
+	if shouldHostURL(t, "/payload?debug=1&debug=true", nil, "blacklist_query:\n  debug: '^true$'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_cookie_succeed(t *testing.T) {
+	cookies := []*http.Cookie{{Name: "session", Value: "landing-visited"}}
+	if !shouldHostURL(t, "/payload", cookies, "authorized_cookies:\n  session: '^landing-'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_cookie_fail(t *testing.T) {
+	if shouldHostURL(t, "/payload", nil, "authorized_cookies:\n  session: '^landing-'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_cookie_bl(t *testing.T) {
+	cookies := []*http.Cookie{{Name: "sandbox", Value: "1"}}
+	if shouldHostURL(t, "/payload", cookies, "blacklist_cookies:\n  sandbox: '.*'") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_cookie_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("authorized_cookies:\n  session: '['")); err == nil {
+		t.Fail()
+	}
+}
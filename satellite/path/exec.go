@@ -0,0 +1,508 @@
+package path
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httputil"
+	"github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// DefaultExecTimeout is how long a script may run when exec.timeout is not set
+const DefaultExecTimeout = 5 * time.Second
+
+// Exec protocols. The text protocol gives the script the raw request on
+// stdin and compares its output to exec.output. The JSON protocol gives the
+// script an ExecRequest on stdin and reads an ExecVerdict from stdout
+const (
+	ExecProtocolText = "text"
+	ExecProtocolJSON = "json"
+)
+
+// Exec runs a script or binary to decide if a request is served
+type Exec struct {
+	// ScriptPath is the script or binary to run
+	ScriptPath string `yaml:"script"`
+	// Output is the stdout, without the trailing newline, which allows a request with the text protocol
+	Output string `yaml:"output"`
+	// Args are the arguments given to the script
+	Args []string `yaml:"args,omitempty"`
+	// Env are environment variables added to the environment of satellite
+	Env map[string]string `yaml:"env,omitempty"`
+	// Timeout is how long the script may run, such as 2s. A script which
+	// times out denies the request
+	Timeout string `yaml:"timeout,omitempty"`
+	// Protocol is text or json. The default is text
+	Protocol string `yaml:"protocol,omitempty"`
+	// CacheTTL is how long a verdict is cached for, such as 10m. Verdicts are
+	// not cached when empty
+	CacheTTL string `yaml:"cache_ttl,omitempty"`
+	// CacheKey is what verdicts are cached per: ip, subnet or ja3. The default is ip
+	CacheKey string `yaml:"cache_key,omitempty"`
+}
+
+// ExecRequest is the document given to scripts using the JSON protocol
+type ExecRequest struct {
+	IP      string              `json:"ip"`
+	Method  string              `json:"method"`
+	Host    string              `json:"host"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	JA3     string              `json:"ja3"`
+	JA4     string              `json:"ja4"`
+	JA4H    string              `json:"ja4h"`
+	SNI     string              `json:"sni,omitempty"`
+	GeoIP   *ExecGeoIP          `json:"geoip,omitempty"`
+	Hits    ExecHits            `json:"hits"`
+}
+
+// ExecGeoIP is the GeoIP information of the client
+type ExecGeoIP struct {
+	Country      string   `json:"country,omitempty"`
+	Subdivisions []string `json:"subdivisions,omitempty"`
+	City         string   `json:"city,omitempty"`
+	Latitude     float64  `json:"latitude,omitempty"`
+	Longitude    float64  `json:"longitude,omitempty"`
+	ASN          uint     `json:"asn,omitempty"`
+	ASNOrg       string   `json:"asn_org,omitempty"`
+}
+
+// ExecHits is the hit history of the path and the client
+type ExecHits struct {
+	// Path is the number of times the path was served
+	Path uint64 `json:"path"`
+	// IP is the number of times the path was served to the client IP, counted when serve_per_ip is set
+	IP uint64 `json:"ip"`
+	// JA3 is the number of times the path was served to the client JA3N, counted when serve_per_ja3 is set
+	JA3 uint64 `json:"ja3"`
+	// History are the paths served to the client IP, oldest first
+	History []string `json:"history"`
+}
+
+// ExecVerdict is the decision of a script using the JSON protocol or of a webhook
+type ExecVerdict struct {
+	Allow bool `json:"allow"`
+	// Reason is logged with the verdict
+	Reason string `json:"reason,omitempty"`
+	// Response overrides the response to the request
+	Response *ExecResponse `json:"response,omitempty"`
+}
+
+// ExecResponse overrides the response to a request. Headers are added to
+// the response. When a status or body is set, it is sent instead of the file
+// or the on_failure route
+type ExecResponse struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// write adds the override headers and writes the status and body. It
+// returns true when the response was written
+func (r *ExecResponse) write(w http.ResponseWriter) bool {
+	if r == nil {
+		return false
+	}
+	writeHeaders(w, r.Headers)
+	if r.Status == 0 && r.Body == "" {
+		return false
+	}
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
+	w.Write([]byte(r.Body))
+	return true
+}
+
+// verdictCache caches verdicts per client. It is safe for concurrent use
+type verdictCache struct {
+	mu        sync.Mutex
+	entries   map[string]verdictEntry
+	nextSweep time.Time
+}
+
+type verdictEntry struct {
+	verdict ExecVerdict
+	expires time.Time
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{entries: make(map[string]verdictEntry)}
+}
+
+func (v *verdictCache) get(key string) (ExecVerdict, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.entries[key]
+	if !ok {
+		return ExecVerdict{}, false
+	}
+	if !now().Before(entry.expires) {
+		delete(v.entries, key)
+		return ExecVerdict{}, false
+	}
+	return entry.verdict, true
+}
+
+func (v *verdictCache) set(key string, verdict ExecVerdict, ttl time.Duration) {
+	t := now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.sweep(t)
+	v.entries[key] = verdictEntry{verdict: verdict, expires: t.Add(ttl)}
+}
+
+// sweep removes expired verdicts, at most once a minute
+func (v *verdictCache) sweep(t time.Time) {
+	if t.Before(v.nextSweep) {
+		return
+	}
+	for key, entry := range v.entries {
+		if !t.Before(entry.expires) {
+			delete(v.entries, key)
+		}
+	}
+	v.nextSweep = t.Add(time.Minute)
+}
+
+// Validate ensures the durations can be parsed and the protocol is known
+func (e Exec) Validate() error {
+	for _, d := range []string{e.Timeout, e.CacheTTL} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return errors.Wrapf(err, "%s is not a valid duration", d)
+		}
+	}
+	switch e.Protocol {
+	case "", ExecProtocolText, ExecProtocolJSON:
+	default:
+		return errors.New(fmt.Sprintf("%s is not a valid exec protocol", e.Protocol))
+	}
+	if !validClient(e.cacheKey()) {
+		return errors.New(fmt.Sprintf("%s is not a valid exec cache key", e.CacheKey))
+	}
+	return nil
+}
+
+func (e Exec) timeout() time.Duration {
+	if d, err := time.ParseDuration(e.Timeout); err == nil {
+		return d
+	}
+	return DefaultExecTimeout
+}
+
+func (e Exec) cacheKey() string {
+	if e.CacheKey == "" {
+		return RatePerIP
+	}
+	return strings.ToLower(e.CacheKey)
+}
+
+// conditionCacheKeys returns the exec and webhook cache keys of the
+// conditions and their nested blocks
+func conditionCacheKeys(c RequestConditions) []string {
+	var keys []string
+	if c.Exec.CacheKey != "" {
+		keys = append(keys, c.Exec.cacheKey())
+	}
+	if c.Webhook.CacheKey != "" {
+		keys = append(keys, c.Webhook.cacheKey())
+	}
+	for _, blocks := range [][]RequestConditions{c.AllOf, c.AnyOf, c.Not} {
+		for _, b := range blocks {
+			keys = append(keys, conditionCacheKeys(b)...)
+		}
+	}
+	return keys
+}
+
+// scriptPipes are the stdin, stdout and stderr of a script. The script is
+// given the pipes themselves instead of ones copied by os/exec, so Wait
+// returns once it exits even when its children hold them open
+type scriptPipes struct {
+	wg sync.WaitGroup
+	// child are the ends given to the script
+	child []*os.File
+	// parent are the ends read and written here
+	parent []*os.File
+}
+
+// input returns a pipe the script reads data from
+func (p *scriptPipes) input(data []byte) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.child = append(p.child, r)
+	p.parent = append(p.parent, w)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		w.Write(data)
+		w.Close()
+	}()
+	return r, nil
+}
+
+// output returns a pipe the script writes buf with
+func (p *scriptPipes) output(buf *bytes.Buffer) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.child = append(p.child, w)
+	p.parent = append(p.parent, r)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		io.Copy(buf, r)
+	}()
+	return w, nil
+}
+
+// started closes the ends of the script once it has its own copies
+func (p *scriptPipes) started() {
+	for _, f := range p.child {
+		f.Close()
+	}
+}
+
+// wait waits for the pipes to be copied until ctx is done, then closes them
+// and waits for the copies to stop
+func (p *scriptPipes) wait(ctx context.Context) {
+	copied := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-ctx.Done():
+	}
+	for _, f := range p.parent {
+		f.Close()
+	}
+	<-copied
+}
+
+// run runs the script with stdin and returns its stdout and stderr. When
+// combined is set, stderr goes to stdout in the order the script writes them,
+// like cmd.CombinedOutput. A script which outlives the timeout is killed
+func (e Exec) run(stdin []byte, combined bool) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.ScriptPath, e.Args...)
+	if len(e.Env) != 0 {
+		cmd.Env = os.Environ()
+		for k, v := range e.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+
+	var pipes scriptPipes
+	var stdout, stderr bytes.Buffer
+	err := func() (err error) {
+		if cmd.Stdin, err = pipes.input(stdin); err != nil {
+			return err
+		}
+		if cmd.Stdout, err = pipes.output(&stdout); err != nil {
+			return err
+		}
+		if combined {
+			cmd.Stderr = cmd.Stdout
+			return nil
+		}
+		cmd.Stderr, err = pipes.output(&stderr)
+		return err
+	}()
+	if err == nil {
+		err = cmd.Start()
+	}
+	pipes.started()
+	if err != nil {
+		cancel()
+		pipes.wait(ctx)
+		return nil, nil, err
+	}
+
+	// The script is killed when ctx is done, so Wait returns by the timeout
+	err = cmd.Wait()
+	pipes.wait(ctx)
+	if ctx.Err() != nil {
+		return nil, nil, errors.Wrapf(ctx.Err(), "%s timed out", e.ScriptPath)
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// newExecRequest builds the document given to scripts using the JSON protocol
+func (c *RequestConditions) newExecRequest(req *http.Request, state *State, gip geoip.DB) (ExecRequest, error) {
+	body, err := peekBody(req, c.maxBodySize())
+	if err != nil {
+		return ExecRequest{}, err
+	}
+
+	ip := util.GetHost(req)
+	doc := ExecRequest{
+		Method:  req.Method,
+		Host:    req.Host,
+		Headers: req.Header,
+		Body:    string(body),
+		JA3:     req.JA3Fingerprint,
+		JA4:     req.JA4Fingerprint,
+		JA4H:    req.JA4HFingerprint,
+	}
+	if ip != nil {
+		doc.IP = ip.String()
+	}
+	if req.URL != nil {
+		doc.Path = req.URL.Path
+		doc.Query = req.URL.RawQuery
+	}
+	if req.TLS != nil {
+		doc.SNI = req.TLS.ServerName
+	}
+
+	if ip != nil && (gip.HasDB() || gip.HasASN()) {
+		doc.GeoIP = &ExecGeoIP{}
+		if gip.HasDB() {
+			if loc, err := gip.Location(ip); err == nil {
+				doc.GeoIP.Country = loc.CountryCode
+				doc.GeoIP.Subdivisions = loc.Subdivisions
+				doc.GeoIP.City = loc.City
+				doc.GeoIP.Latitude = loc.Latitude
+				doc.GeoIP.Longitude = loc.Longitude
+			} else if country, err := gip.CountryCode(ip); err == nil {
+				doc.GeoIP.Country = country
+			}
+		}
+		if gip.HasASN() {
+			if asn, org, err := gip.ASN(ip); err == nil {
+				doc.GeoIP.ASN = asn
+				doc.GeoIP.ASNOrg = org
+			}
+		}
+	}
+
+	doc.Hits.History = []string{}
+	if state != nil && req.URL != nil {
+		doc.Hits.Path, _ = state.GetHits(req.URL.Path)
+		if ip != nil {
+			doc.Hits.IP, _ = state.GetHitsBy(req.URL.Path, ServeIP, ip.String())
+			doc.Hits.History = state.History(ip)
+		}
+		if req.JA3Fingerprint != "" {
+			doc.Hits.JA3, _ = state.GetHitsBy(req.URL.Path, ServeJA3, ja3Key(req.JA3Fingerprint))
+		}
+	}
+
+	return doc, nil
+}
+
+// execVerdict runs the script and returns its verdict
+func (c *RequestConditions) execVerdict(req *http.Request, state *State, gip geoip.DB) (ExecVerdict, error) {
+	e := c.Exec
+
+	if e.Protocol != ExecProtocolJSON {
+		dump, err := httputil.DumpRequest(req, true)
+		if err != nil {
+			return ExecVerdict{}, err
+		}
+		out, _, err := e.run(dump, true)
+		if err != nil {
+			return ExecVerdict{}, err
+		}
+		return ExecVerdict{Allow: e.Output == strings.TrimSuffix(string(out), "\n")}, nil
+	}
+
+	doc, err := c.newExecRequest(req, state, gip)
+	if err != nil {
+		return ExecVerdict{}, err
+	}
+	stdin, err := json.Marshal(doc)
+	if err != nil {
+		return ExecVerdict{}, err
+	}
+	stdout, stderr, err := e.run(stdin, false)
+	if err != nil {
+		return ExecVerdict{}, errors.Wrap(err, strings.TrimSpace(string(stderr)))
+	}
+
+	var verdict ExecVerdict
+	if err := json.Unmarshal(stdout, &verdict); err != nil {
+		return ExecVerdict{}, errors.Wrap(err, "invalid verdict")
+	}
+	return verdict, nil
+}
+
+func (c *RequestConditions) authorizedExec(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+	if c.Exec.ScriptPath == "" {
+		return true, nil
+	}
+
+	var key string
+	ttl, err := time.ParseDuration(c.Exec.CacheTTL)
+	cache := err == nil && ttl > 0 && state != nil
+	// Clients without an identifier, such as requests without TLS for the
+	// ja3 key, would all share one verdict
+	client := clientIdentifier(req, c.Exec.cacheKey())
+	if cache && client == "" {
+		log.WithFields(log.Fields{
+			"cache_key": c.Exec.cacheKey(),
+		}).Debug("No client to cache the exec verdict for")
+		cache = false
+	}
+	if cache {
+		var path string
+		if req.URL != nil {
+			path = req.URL.Path
+		}
+		key = fmt.Sprintf("%s\x00%s\x00%q\x00%s\x00%s", path, c.Exec.ScriptPath, c.Exec.Args, c.Exec.cacheKey(), client)
+		if verdict, ok := state.execVerdicts.get(key); ok {
+			log.WithFields(log.Fields{
+				"script": c.Exec.ScriptPath,
+				"allow":  verdict.Allow,
+				"reason": verdict.Reason,
+			}).Debug("Cached exec verdict")
+			return verdict.Allow, verdict.Response
+		}
+	}
+
+	verdict, err := c.execVerdict(req, state, gip)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"script": c.Exec.ScriptPath,
+			"error":  err,
+		}).Debug("Exec failed")
+		return false, nil
+	}
+
+	log.WithFields(log.Fields{
+		"script": c.Exec.ScriptPath,
+		"allow":  verdict.Allow,
+		"reason": verdict.Reason,
+	}).Debug("Exec verdict")
+
+	if cache {
+		state.execVerdicts.set(key, verdict, ttl)
+	}
+	return verdict.Allow, verdict.Response
+}
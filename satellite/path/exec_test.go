@@ -0,0 +1,356 @@
+package path_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+// writeScript writes an executable shell script and returns its path
+func writeScript(t *testing.T, dir, body string) string {
+	name := filepath.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(name, []byte("#!/bin/sh\n"+body), 0777); err != nil {
+		t.Error(err)
+	}
+	return name
+}
+
+// shouldHostExec runs the exec conditions in data, where SCRIPT is replaced
+// by the path of a script with body
+func shouldHostExec(t *testing.T, body, data string) bool {
+	dir, err := ioutil.TempDir("", "satelliteexec")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	req := httptest.NewRequest("POST", "/payload", strings.NewReader("user=admin"))
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("User-Agent", "curl/7.64.1")
+	req.JA3Fingerprint = "771,4865-4866,0-23-65281-10,29-23,0"
+	// A previous serve of a path with serve_per_ip
+	if err := state.Hit(req); err != nil {
+		t.Error(err)
+	}
+	if err := state.HitBy("/payload", ServeIP, "198.51.100.1"); err != nil {
+		t.Error(err)
+	}
+
+	script := writeScript(t, dir, body)
+	conditions, err := NewRequestConditions([]byte(strings.Replace(data, "SCRIPT", script, -1)))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(req, state, geoip.DB{})
+}
+
+func TestRequestConditions_ShouldHost_exec_args_env(t *testing.T) {
+	body := `[ "$1" = "--strict" ] && [ "$MODE" = "test" ] && echo ok`
+	data := `
+exec:
+  script: SCRIPT
+  output: ok
+  args: [--strict]
+  env:
+    MODE: test`
+	if !shouldHostExec(t, body, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_combined_output(t *testing.T) {
+	// The text protocol matches stdout and stderr in the order they were written
+	body := "printf a; printf b >&2; printf c"
+	data := `
+exec:
+  script: SCRIPT
+  output: abc`
+	if !shouldHostExec(t, body, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_timeout(t *testing.T) {
+	data := `
+exec:
+  script: SCRIPT
+  output: ok
+  timeout: 100ms`
+
+	start := time.Now()
+	if shouldHostExec(t, "sleep 5\necho ok", data) {
+		t.Fail()
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("script was not killed")
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_timeout_child(t *testing.T) {
+	data := `
+exec:
+  script: SCRIPT
+  output: ok
+  timeout: 100ms`
+
+	// The child of the script holds stdout open after the script is killed
+	goroutines := runtime.NumGoroutine()
+	if shouldHostExec(t, "sleep 5 &\nsleep 5\necho ok", data) {
+		t.Fail()
+	}
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 10 {
+			t.Error("goroutines of the script were leaked")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_json_allow(t *testing.T) {
+	body := `doc=$(cat)
+for want in '"ip":"198.51.100.1"' '"method":"POST"' '"body":"user=admin"' '"ja3":"771,' '"history":["/payload"]' '"ip":1' '"User-Agent":["curl/7.64.1"]'; do
+	case "$doc" in
+	*"$want"*) ;;
+	*) echo "{\"allow\": false, \"reason\": \"missing $want\"}"; exit 0 ;;
+	esac
+done
+echo '{"allow": true, "reason": "looks like the target"}'`
+	data := `
+exec:
+  script: SCRIPT
+  protocol: json`
+	if !shouldHostExec(t, body, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_json_deny(t *testing.T) {
+	data := `
+exec:
+  script: SCRIPT
+  protocol: json`
+	if shouldHostExec(t, `echo '{"allow": false, "reason": "sandbox"}'`, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_json_invalid(t *testing.T) {
+	data := `
+exec:
+  script: SCRIPT
+  protocol: json`
+	if shouldHostExec(t, "echo ok", data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_exec_cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satelliteexec")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+	counter := filepath.Join(dir, "runs")
+
+	body := fmt.Sprintf("echo run >> %s\necho '{\"allow\": true}'", counter)
+	data := `
+exec:
+  script: SCRIPT
+  protocol: json
+  cache_ttl: 1m`
+
+	// Verdicts are cached per path, script and client, so every request shares one script
+	script := writeScript(t, dir, body)
+	conditions, err := NewRequestConditions([]byte(strings.Replace(data, "SCRIPT", script, -1)))
+	if err != nil {
+		t.Error(err)
+	}
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	requests := []struct{ path, addr string }{
+		{"/", "198.51.100.1:1"},
+		{"/", "198.51.100.1:2"},
+		{"/", "198.51.100.2:1"},
+		{"/other", "198.51.100.1:1"},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest("GET", r.path, nil)
+		req.RemoteAddr = r.addr
+		if !conditions.ShouldHost(req, state, geoip.DB{}) {
+			t.Error("request was not hosted")
+		}
+	}
+
+	runs, err := ioutil.ReadFile(counter)
+	if err != nil {
+		t.Error(err)
+	}
+	if n := strings.Count(string(runs), "run"); n != 3 {
+		t.Errorf("script ran %d times", n)
+	}
+}
+
+func TestNewRequestConditions_exec_bad(t *testing.T) {
+	for _, data := range []string{
+		"exec: {script: /bin/true, timeout: soon}",
+		"exec: {script: /bin/true, protocol: xml}",
+		"exec: {script: /bin/true, cache_ttl: 1m, cache_key: asn}",
+	} {
+		if _, err := NewRequestConditions([]byte(data)); err == nil {
+			t.Errorf("%s is valid", data)
+		}
+	}
+}
+
+func TestPaths_MatchAndServe_exec_response(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+
+	script := writeScript(t, serverRoot.Path, `echo '{"allow": false, "response": {"status": 403, "headers": {"X-Reason": "sandbox"}, "body": "denied"}}'`)
+	serverRoot.CreatePathListIndex("exec:", "  script: "+script, "  protocol: json")
+
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	w := httptest.NewRecorder()
+	served, err := paths.MatchAndServe(w, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if !served || w.Code != 403 || w.Body.String() != "denied" || w.Header().Get("X-Reason") != "sandbox" {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_exec_response_all_of(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satelliteexec")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+	script := writeScript(t, dir, `echo '{"allow": false, "response": {"status": 403}}'`)
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("all_of:\n- exec:\n    script: " + script + "\n    protocol: json"))
+	if err != nil {
+		t.Error(err)
+	}
+	ok, _, resp := conditions.ShouldHostScore(httptest.NewRequest("GET", "/", nil), state, geoip.DB{})
+	if ok || resp == nil || resp.Status != 403 {
+		t.Fail()
+	}
+}
+
+func TestPaths_MatchAndServe_exec_response_any_of(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+
+	script := writeScript(t, serverRoot.Path, `echo '{"allow": false, "response": {"status": 404, "body": "nope"}}'`)
+	serverRoot.CreatePathListIndex(
+		"any_of:",
+		"  - exec:",
+		"      script: "+script,
+		"      protocol: json",
+		"  - authorized_methods:",
+		"      - GET",
+	)
+
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	w := httptest.NewRecorder()
+	served, err := paths.MatchAndServe(w, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if !served || w.Code != 200 || w.Body.String() != Sentinal {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_exec_response_any_of(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satelliteexec")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+	script := writeScript(t, dir, `echo '{"allow": false, "response": {"status": 404, "body": "nope"}}'`)
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("any_of:\n- exec:\n    script: " + script + "\n    protocol: json\n- authorized_methods: [GET]"))
+	if err != nil {
+		t.Error(err)
+	}
+	ok, _, resp := conditions.ShouldHostScore(httptest.NewRequest("GET", "/", nil), state, geoip.DB{})
+	if !ok || resp != nil {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_exec_response_not(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satelliteexec")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+	script := writeScript(t, dir, `echo '{"allow": true, "response": {"status": 200, "body": "welcome"}}'`)
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("not:\n- exec:\n    script: " + script + "\n    protocol: json"))
+	if err != nil {
+		t.Error(err)
+	}
+	ok, _, resp := conditions.ShouldHostScore(httptest.NewRequest("GET", "/", nil), state, geoip.DB{})
+	if ok || resp != nil {
+		t.Fail()
+	}
+}
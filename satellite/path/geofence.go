@@ -0,0 +1,138 @@
+package path
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// Geofence is a circle around a point on the map
+type Geofence struct {
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+	// RadiusKM is the radius of the circle in kilometers
+	RadiusKM float64 `yaml:"radius_km"`
+}
+
+// Validate ensures the geofence is a real place
+func (g Geofence) Validate() error {
+	if g.Latitude < -90 || g.Latitude > 90 {
+		return errors.New(fmt.Sprintf("%f is not a valid latitude", g.Latitude))
+	}
+	if g.Longitude < -180 || g.Longitude > 180 {
+		return errors.New(fmt.Sprintf("%f is not a valid longitude", g.Longitude))
+	}
+	if g.RadiusKM <= 0 {
+		return errors.New("geofence radius_km must be positive")
+	}
+	return nil
+}
+
+// Contains checks if the location is within the geofence
+func (g Geofence) Contains(loc geoip.Location) bool {
+	return loc.HasCoordinates() && loc.DistanceKM(g.Latitude, g.Longitude) <= g.RadiusKM
+}
+
+func (c *RequestConditions) geoLocationMatch(req *http.Request, gip geoip.DB) bool {
+	geo := c.GeoIP
+	if len(geo.AuthorizedRegions) == 0 && len(geo.BlacklistRegions) == 0 &&
+		len(geo.AuthorizedCities) == 0 && len(geo.BlacklistCities) == 0 && len(geo.Geofence) == 0 {
+		log.Trace("No GeoIP location conditions")
+		return true
+	}
+
+	if !gip.HasCity() {
+		log.Debug("No GeoIP City database, skipping GeoIP location conditions")
+		return true
+	}
+
+	loc, err := gip.Location(util.GetHost(req))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Error getting location")
+		return false
+	}
+
+	// Authorized regions
+	if len(geo.AuthorizedRegions) != 0 && !matchRegion(geo.AuthorizedRegions, loc.Subdivisions) {
+		log.WithFields(log.Fields{
+			"regions": loc.Subdivisions,
+		}).Debug("Did not match authorized region")
+		return false
+	}
+
+	// Blacklist regions
+	if matchRegion(geo.BlacklistRegions, loc.Subdivisions) {
+		log.WithFields(log.Fields{
+			"regions": loc.Subdivisions,
+		}).Debug("Matched blacklisted region")
+		return false
+	}
+
+	// Authorized cities
+	if len(geo.AuthorizedCities) != 0 && !matchCity(geo.AuthorizedCities, loc.City) {
+		log.WithFields(log.Fields{
+			"city": loc.City,
+		}).Debug("Did not match authorized city")
+		return false
+	}
+
+	// Blacklist cities
+	if matchCity(geo.BlacklistCities, loc.City) {
+		log.WithFields(log.Fields{
+			"city": loc.City,
+		}).Debug("Matched blacklisted city")
+		return false
+	}
+
+	// Geofence
+	if len(geo.Geofence) != 0 {
+		for _, g := range geo.Geofence {
+			if g.Contains(loc) {
+				log.WithFields(log.Fields{
+					"latitude":  g.Latitude,
+					"longitude": g.Longitude,
+					"radius_km": g.RadiusKM,
+				}).Debug("Matched geofence")
+				return true
+			}
+			log.WithFields(log.Fields{
+				"latitude":  g.Latitude,
+				"longitude": g.Longitude,
+				"radius_km": g.RadiusKM,
+			}).Trace("Did not match geofence")
+		}
+		return false
+	}
+
+	return true
+}
+
+func matchRegion(targets, regions []string) bool {
+	for _, t := range targets {
+		for _, r := range regions {
+			if strings.EqualFold(t, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchCity(targets []string, city string) bool {
+	if city == "" {
+		return false
+	}
+	for _, t := range targets {
+		if strings.EqualFold(t, city) {
+			return true
+		}
+	}
+	return false
+}
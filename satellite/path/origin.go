@@ -0,0 +1,248 @@
+package path
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+)
+
+// languageRange is a language tag with its q-value, as found in Accept-Language
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// parseLanguageRange parses a language range such as de-DE;q=0.8. The q-value
+// defaults to 0 so a configured range without one accepts any preference
+func parseLanguageRange(s string) (languageRange, error) {
+	parts := strings.Split(s, ";")
+	r := languageRange{tag: strings.ToLower(strings.TrimSpace(parts[0]))}
+	if !validLanguageTag(r.tag) {
+		return r, errors.New(fmt.Sprintf("%s is not a valid language range", s))
+	}
+
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 || strings.ToLower(kv[0]) != "q" {
+			return r, errors.New(fmt.Sprintf("%s is not a valid language range", s))
+		}
+		q, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || q < 0 || q > 1 {
+			return r, errors.New(fmt.Sprintf("%s is not a valid q-value", kv[1]))
+		}
+		r.q = q
+	}
+
+	return r, nil
+}
+
+func validLanguageTag(tag string) bool {
+	if tag == "*" {
+		return true
+	}
+	for _, sub := range strings.Split(tag, "-") {
+		if len(sub) == 0 || len(sub) > 8 {
+			return false
+		}
+		for _, c := range sub {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// acceptLanguages parses the Accept-Language header of the request. Entries
+// without a q-value have a q-value of 1 and malformed entries are skipped
+func acceptLanguages(req *http.Request) []languageRange {
+	var languages []languageRange
+	for _, header := range req.Header["Accept-Language"] {
+		for _, entry := range strings.Split(header, ",") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			r, err := parseLanguageRange(entry)
+			if err != nil {
+				continue
+			}
+			if !strings.Contains(entry, ";") {
+				r.q = 1
+			}
+			languages = append(languages, r)
+		}
+	}
+	return languages
+}
+
+// match checks if the client language is covered by the configured range.
+// A range matches its own tag and any tag it is a prefix of, so de matches
+// de-DE but de-DE does not match de
+func (r languageRange) match(client languageRange) bool {
+	if client.q <= 0 || client.q < r.q {
+		return false
+	}
+	return r.tag == "*" || client.tag == r.tag || strings.HasPrefix(client.tag, r.tag+"-")
+}
+
+// acceptsLanguage returns the first client language covered by one of the ranges
+func acceptsLanguage(ranges []string, languages []languageRange) (string, string, bool) {
+	for _, l := range ranges {
+		r, err := parseLanguageRange(l)
+		if err != nil {
+			continue
+		}
+		for _, client := range languages {
+			if r.match(client) {
+				return l, client.tag, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func (c *RequestConditions) authorizedLanguages(req *http.Request) bool {
+	if len(c.AuthorizedLanguages) == 0 {
+		log.Trace("No authorized languages")
+		return true
+	}
+
+	target, language, ok := acceptsLanguage(c.AuthorizedLanguages, acceptLanguages(req))
+	if !ok {
+		log.WithFields(log.Fields{
+			"accept_language": req.Header.Get("Accept-Language"),
+		}).Debug("Did not match authorized language")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"language":        language,
+		"target_language": target,
+	}).Debug("Matched authorized language")
+	return true
+}
+
+func (c *RequestConditions) blacklistLanguages(req *http.Request) bool {
+	if len(c.BlacklistLanguages) == 0 {
+		log.Trace("No blacklist languages")
+		return true
+	}
+
+	target, language, ok := acceptsLanguage(c.BlacklistLanguages, acceptLanguages(req))
+	if ok {
+		log.WithFields(log.Fields{
+			"language":        language,
+			"target_language": target,
+		}).Debug("Blacklisted language")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"accept_language": req.Header.Get("Accept-Language"),
+	}).Trace("Did not match blacklisted language")
+	return true
+}
+
+func (c *RequestConditions) authorizedReferers(req *http.Request) bool {
+	if len(c.AuthorizedReferers) == 0 && len(c.AuthorizedReferersGlob) == 0 {
+		log.Trace("No authorized referers")
+		return true
+	}
+
+	referer := req.Referer()
+	for _, r := range c.AuthorizedReferers {
+		if regexp.MustCompile(r).MatchString(referer) {
+			log.WithFields(log.Fields{
+				"referer":        referer,
+				"target_referer": r,
+			}).Debug("Matched authorized referer")
+			return true
+		}
+	}
+	for _, r := range c.AuthorizedReferersGlob {
+		if glob.MustCompile(r).Match(referer) {
+			log.WithFields(log.Fields{
+				"referer":        referer,
+				"target_referer": r,
+			}).Debug("Matched authorized referer")
+			return true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"referer": referer,
+	}).Debug("Did not match authorized referer")
+	return false
+}
+
+func (c *RequestConditions) blacklistReferers(req *http.Request) bool {
+	referer := req.Referer()
+	for _, r := range c.BlacklistReferers {
+		if regexp.MustCompile(r).MatchString(referer) {
+			log.WithFields(log.Fields{
+				"referer":        referer,
+				"target_referer": r,
+			}).Debug("Blacklisted referer")
+			return false
+		}
+	}
+	for _, r := range c.BlacklistReferersGlob {
+		if glob.MustCompile(r).Match(referer) {
+			log.WithFields(log.Fields{
+				"referer":        referer,
+				"target_referer": r,
+			}).Debug("Blacklisted referer")
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost checks the Host header against the globs, ignoring case and port
+func matchHost(globs []string, req *http.Request) (string, bool) {
+	host := strings.ToLower(requestHost(req))
+	for _, h := range globs {
+		if glob.MustCompile(strings.ToLower(h)).Match(host) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+func (c *RequestConditions) authorizedHosts(req *http.Request) bool {
+	if len(c.AuthorizedHosts) == 0 {
+		log.Trace("No authorized hosts")
+		return true
+	}
+
+	target, ok := matchHost(c.AuthorizedHosts, req)
+	if !ok {
+		log.WithFields(log.Fields{
+			"host": req.Host,
+		}).Debug("Did not match authorized host")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"host":        req.Host,
+		"target_host": target,
+	}).Debug("Matched authorized host")
+	return true
+}
+
+func (c *RequestConditions) blacklistHosts(req *http.Request) bool {
+	if target, ok := matchHost(c.BlacklistHosts, req); ok {
+		log.WithFields(log.Fields{
+			"host":        req.Host,
+			"target_host": target,
+		}).Debug("Blacklisted host")
+		return false
+	}
+	return true
+}
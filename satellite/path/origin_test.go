@@ -0,0 +1,165 @@
+package path_test
+
+import (
+	"testing"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+func shouldHostOrigin(t *testing.T, setup func(*http.Request), data string) bool {
+	mockRequest := httptest.NewRequest("GET", "/", nil)
+	setup(mockRequest)
+
+	db, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, db, geoip.DB{})
+}
+
+func withLanguage(language string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("Accept-Language", language)
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_succeed(t *testing.T) {
+	if !shouldHostOrigin(t, withLanguage("de-DE,de;q=0.9,en;q=0.8"), "authorized_languages: [de]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_fail(t *testing.T) {
+	if shouldHostOrigin(t, withLanguage("en-US,en;q=0.9"), "authorized_languages: [de]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_missing(t *testing.T) {
+	if shouldHostOrigin(t, func(*http.Request) {}, "authorized_languages: [de]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_q_zero(t *testing.T) {
+	if shouldHostOrigin(t, withLanguage("en, de;q=0"), "authorized_languages: [de]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_min_q(t *testing.T) {
+	if shouldHostOrigin(t, withLanguage("en, de;q=0.3"), "authorized_languages: ['de;q=0.5']") {
+		t.Fail()
+	}
+	if !shouldHostOrigin(t, withLanguage("en, de;q=0.7"), "authorized_languages: ['de;q=0.5']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_specific(t *testing.T) {
+	if shouldHostOrigin(t, withLanguage("de"), "authorized_languages: [de-at]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_language_bl(t *testing.T) {
+	if shouldHostOrigin(t, withLanguage("en-US, ru;q=0.2"), "blacklist_languages: [ru]") {
+		t.Fail()
+	}
+	if !shouldHostOrigin(t, withLanguage("en-US"), "blacklist_languages: [ru]") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_language_fail(t *testing.T) {
+	for _, data := range []string{"authorized_languages: ['de;q=2']", "blacklist_languages: ['d e']"} {
+		if _, err := NewRequestConditions([]byte(data)); err == nil {
+			t.Errorf("%s should not be valid", data)
+		}
+	}
+}
+
+func TestRequestConditions_ShouldHost_referer_succeed(t *testing.T) {
+	setup := func(req *http.Request) {
+		req.Header.Set("Referer", "https://outlook.office.com/mail/inbox")
+	}
+	if !shouldHostOrigin(t, setup, "authorized_referers: ['^https://outlook\\.']") {
+		t.Fail()
+	}
+	if !shouldHostOrigin(t, setup, "authorized_referers_glob: ['https://outlook.*']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_referer_fail(t *testing.T) {
+	if shouldHostOrigin(t, func(*http.Request) {}, "authorized_referers_glob: ['https://outlook.*']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_referer_bl(t *testing.T) {
+	setup := func(req *http.Request) {
+		req.Header.Set("Referer", "https://www.virustotal.com/gui/url/1")
+	}
+	if shouldHostOrigin(t, setup, "blacklist_referers: [virustotal]") {
+		t.Fail()
+	}
+	if shouldHostOrigin(t, setup, "blacklist_referers_glob: ['*virustotal*']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_host_succeed(t *testing.T) {
+	setup := func(req *http.Request) {
+		req.Host = "Files.Example.com:8443"
+	}
+	if !shouldHostOrigin(t, setup, "authorized_hosts: [files.example.com]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_host_fail(t *testing.T) {
+	setup := func(req *http.Request) {
+		req.Host = "203.0.113.7"
+	}
+	if shouldHostOrigin(t, setup, "authorized_hosts: ['*.example.com']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_host_bl(t *testing.T) {
+	setup := func(req *http.Request) {
+		req.Host = "staging.example.com"
+	}
+	if shouldHostOrigin(t, setup, "blacklist_hosts: ['staging.*']") {
+		t.Fail()
+	}
+}
+
+func TestMergeRequestConditions_origin(t *testing.T) {
+	global, err := NewRequestConditions([]byte("authorized_languages: [de]\nblacklist_hosts: ['staging.*']"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact, err := NewRequestConditions([]byte("authorized_languages: [fr]\nauthorized_referers_glob: ['*outlook*']"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergeRequestConditions(global, exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.AuthorizedLanguages) != 2 || len(merged.BlacklistHosts) != 1 || len(merged.AuthorizedReferersGlob) != 1 {
+		t.Fail()
+	}
+}
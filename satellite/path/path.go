@@ -45,6 +45,12 @@ type Path struct {
 		FileOutput string `yaml:"file_output"`
 	} `yaml:"credential_capture,omitempty"`
 
+	// SignedURL serves the file in the signed token at the end of the URI,
+	// such as /d/<token>, instead of HostedFile
+	SignedURL bool `yaml:"signed_url,omitempty"`
+	// Auth restricts the path to operators
+	Auth *Auth `yaml:"auth,omitempty"`
+
 	Conditions RequestConditions `yaml:",inline"`
 }
 
@@ -111,14 +117,19 @@ func (f *Path) ContentHeaders() map[string]string {
 
 // ShouldHost does the checking to see if the requested file should be given to a target
 func (f *Path) ShouldHost(req *http.Request, state *State, gipDB geoip.DB) bool {
-	shouldHost := f.Conditions.ShouldHost(req, state, gipDB)
+	shouldHost := f.authenticate(req, state) && f.Conditions.ShouldHost(req, state, gipDB)
 	if shouldHost {
-		state.Hit(req)
+		f.Conditions.hit(req, state)
 	}
 
 	return shouldHost
 }
 
+// authenticate checks the auth of the path, when it has one
+func (f *Path) authenticate(req *http.Request, state *State) bool {
+	return f.Auth == nil || f.Auth.Authenticate(req, state.clientCAs)
+}
+
 // FailRedirect will check if the redirect failure route is on and redirect to the new page
 func (f *Path) FailRedirect(w http.ResponseWriter, req *http.Request) bool {
 	if f.OnFailure.Redirect != "" {
@@ -5,9 +5,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 
 	"github.com/gobwas/glob"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/t94j0/satellite/net/http"
 	"github.com/t94j0/satellite/satellite/geoip"
 )
@@ -22,6 +24,18 @@ type Paths struct {
 	state   *State
 	GeoipDB geoip.DB
 	list    []*Path
+
+	// sessionMu guards the session cookies and steps, which change on Reload
+	sessionMu sync.RWMutex
+	// sessionCookies are the session cookies of prereq chains tracked by cookie
+	sessionCookies map[string]bool
+	// sessionSteps are the session cookies issued by each prereq step
+	sessionSteps map[string][]string
+	// signingKey signs signed_url tokens
+	signingKey []byte
+	// tlsOffloaded is set when a proxy terminates TLS, so the JA3 of every
+	// request is the proxy's
+	tlsOffloaded bool
 }
 
 // New creates a new Paths variable from the specified base path
@@ -71,6 +85,18 @@ func (paths *Paths) AddGeoIP(path string) error {
 	return nil
 }
 
+// AddASN adds the GeoIP ASN path to this location. It must be called after AddGeoIP
+func (paths *Paths) AddASN(path string) error {
+	return paths.GeoipDB.OpenASN(path)
+}
+
+// SetTLSOffloaded records whether a proxy terminates TLS in front of the
+// server, and reloads the paths so the ja3 cache key is rejected
+func (paths *Paths) SetTLSOffloaded(offloaded bool) error {
+	paths.tlsOffloaded = offloaded
+	return paths.Reload()
+}
+
 // Len gets the number of paths
 func (paths *Paths) Len() int {
 	return len(paths.list)
@@ -151,6 +177,15 @@ func (paths *Paths) collectConditionalsDirectory(targetPath string) (RequestCond
 		if err != nil {
 			return err
 		}
+		// Session cookies are only issued for the chains of the path list
+		for _, c := range conditionChains(conds) {
+			if c.PrereqOptions.tracksCookie() {
+				return errors.New(oPath + ": prereq chains tracked by cookie can't be global conditions")
+			}
+		}
+		if err := paths.validateCacheKeys(conds); err != nil {
+			return errors.Wrap(err, oPath)
+		}
 
 		condsResult = append(condsResult, conds)
 		return nil
@@ -175,6 +210,23 @@ func (paths *Paths) validate(pathList []*Path) error {
 			return errors.Wrap(err, "unable to compile glob: "+v.Path)
 		}
 
+		// Ensure regexes and globs in conditions compile
+		if err := v.Conditions.Validate(); err != nil {
+			return errors.Wrap(err, "invalid conditions: "+v.Path)
+		}
+
+		// Ensure verdicts are cached per a client the server can identify
+		if err := paths.validateCacheKeys(v.Conditions); err != nil {
+			return errors.Wrap(err, "invalid conditions: "+v.Path)
+		}
+
+		// Ensure the htpasswd file and CA bundle can be read
+		if v.Auth != nil {
+			if err := v.Auth.Load(); err != nil {
+				return errors.Wrap(err, "invalid auth: "+v.Path)
+			}
+		}
+
 		// Ensure paths are backed up by a file
 		// fmt.Println(v.Path)
 	}
@@ -182,6 +234,20 @@ func (paths *Paths) validate(pathList []*Path) error {
 	return nil
 }
 
+// validateCacheKeys rejects the ja3 cache key when TLS is offloaded, since
+// every client would share the verdict cached for the proxy's JA3
+func (paths *Paths) validateCacheKeys(c RequestConditions) error {
+	if !paths.tlsOffloaded {
+		return nil
+	}
+	for _, key := range conditionCacheKeys(c) {
+		if key == RatePerJA3 {
+			return errors.New("the ja3 cache key needs TLS to be terminated by satellite")
+		}
+	}
+	return nil
+}
+
 // Reload refreshes the list of paths internally to Paths
 func (paths *Paths) Reload() error {
 	pathsList, err := paths.ingestPathList()
@@ -189,11 +255,26 @@ func (paths *Paths) Reload() error {
 		return err
 	}
 
+	// Scripts are compiled first so their errors point at the path list
+	data, err := ioutil.ReadFile(paths.pathsList)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scripts, err := paths.loadScripts(pathsList, data)
+	if err != nil {
+		return err
+	}
+
 	if err := paths.validate(pathsList); err != nil {
 		return err
 	}
 
 	paths.list = pathsList
+	paths.sessionMu.Lock()
+	paths.sessionCookies, paths.sessionSteps = prereqSessions(pathsList)
+	paths.sessionMu.Unlock()
+	paths.state.pathIdentifier.SetRetention(prereqRetention(pathsList))
+	paths.state.scripts.replace(scripts)
 
 	return nil
 }
@@ -219,7 +300,7 @@ func getAllConditionals(uri string, paths *Paths, matchedPath *Path) (RequestCon
 		return target, err
 	}
 
-	matchingConditions, err := paths.getMatchingConditionals(uri)
+	matchingConditions, err := paths.getMatchingConditionals(uri, matchedPath)
 	if err != nil {
 		return RequestConditions{}, err
 	}
@@ -227,10 +308,14 @@ func getAllConditionals(uri string, paths *Paths, matchedPath *Path) (RequestCon
 	return MergeRequestConditions(globalConditions, matchingConditions, target)
 }
 
-// getMatchingConditionals gets all conditions that apply to `uri` (since some paths can be globbed) and apply them to matchedPath.Conditions
-func (paths *Paths) getMatchingConditionals(uri string) (RequestConditions, error) {
+// getMatchingConditionals gets all conditions that apply to `uri` (since some paths can be globbed) and apply them to matchedPath.Conditions.
+// matchedPath is skipped, since its conditions are merged last and merging them twice would repeat their lists
+func (paths *Paths) getMatchingConditionals(uri string, matchedPath *Path) (RequestConditions, error) {
 	conditions := make([]RequestConditions, 0)
 	for _, path := range paths.list {
+		if path == matchedPath {
+			continue
+		}
 		g := glob.MustCompile(path.Path, '/')
 		if g.Match(uri) {
 			conditions = append(conditions, path.Conditions)
@@ -265,28 +350,61 @@ func (paths *Paths) getGlobalConditionals() (RequestConditions, error) {
 //
 // Returns true when the file was served and false when a 404 page should be returned
 func (paths *Paths) MatchAndServe(w http.ResponseWriter, req *http.Request) (bool, error) {
+	served, _, err := paths.MatchAndServeScore(w, req)
+	return served, err
+}
+
+// MatchAndServeScore is MatchAndServe which also returns the score of the
+// conditions of the request, or nil when they do not use scoring
+func (paths *Paths) MatchAndServeScore(w http.ResponseWriter, req *http.Request) (bool, *Score, error) {
 	uri := req.URL.Path
 
 	matchedPath, exists := paths.Match(uri)
 	if !exists {
-		return false, nil
+		return false, nil, nil
 	}
 
 	conditions, err := getAllConditionals(uri, paths, matchedPath)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
-	if conditions.ShouldHost(req, paths.state, paths.GeoipDB) {
-		paths.state.Hit(req)
-		if err := matchedPath.ServeHTTP(w, req, paths.base); err != nil {
-			return false, err
+	servedPath, token, err := paths.signedPath(req, matchedPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Signed URL rejected")
+	}
+
+	shouldHost := false
+	var score *Score
+	var resp *ExecResponse
+	if err == nil && matchedPath.authenticate(req, paths.state) {
+		var result Score
+		shouldHost, result, resp = conditions.ShouldHostScore(req, paths.state, paths.GeoipDB)
+		if conditions.Scoring.Enabled() {
+			score = &result
 		}
-		return true, nil
+	}
+
+	if shouldHost && paths.useSignedToken(token) {
+		conditions.hit(req, paths.state)
+		paths.trackSession(w, req)
+		if resp.write(w) {
+			return true, score, nil
+		}
+		if err := servedPath.ServeHTTP(w, req, paths.base); err != nil {
+			return false, score, err
+		}
+		return true, score, nil
+	}
+
+	if resp.write(w) {
+		return true, score, nil
 	}
 
 	if matchedPath.FailRedirect(w, req) {
-		return true, nil
+		return true, score, nil
 	}
 
 	matched, err := matchedPath.FailRender(w, req, func(uri string) *Path {
@@ -297,7 +415,7 @@ func (paths *Paths) MatchAndServe(w http.ResponseWriter, req *http.Request) (boo
 		return newPath
 	}, paths.base)
 	if err != nil {
-		return false, err
+		return false, score, err
 	}
-	return matched, nil
+	return matched, score, nil
 }
@@ -837,3 +837,39 @@ func TestPaths_Reload_globalconditionals_two(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPaths_SetTLSOffloaded_ja3(t *testing.T) {
+	tmpdir, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpdir.Close()
+	tmpdir.CreateIndexFile()
+	tmpdir.CreatePathListIndex("all_of:", "  - webhook: {url: 'https://example.com', cache_ttl: 1m, cache_key: ja3}")
+
+	paths, err := NewDefaultTest(tmpdir.Path)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := paths.SetTLSOffloaded(true); err == nil {
+		t.Error("ja3 cache key was accepted behind a TLS proxy")
+	}
+}
+
+func TestPaths_SetTLSOffloaded_ip(t *testing.T) {
+	tmpdir, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpdir.Close()
+	tmpdir.CreateIndexFile()
+	tmpdir.CreatePathListIndex("webhook: {url: 'https://example.com', cache_ttl: 1m, cache_key: ip}")
+
+	paths, err := NewDefaultTest(tmpdir.Path)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := paths.SetTLSOffloaded(true); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,335 @@
+package path
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// How prereq chains are tracked
+const (
+	PrereqTrackIP     = "ip"
+	PrereqTrackCookie = "cookie"
+	PrereqTrackBoth   = "both"
+)
+
+// How the hits of a client are matched against a prereq chain
+const (
+	// PrereqStrict requires the chain to be the last paths the client hit
+	PrereqStrict = "strict"
+	// PrereqSubsequence requires the chain in order, with any paths in between
+	PrereqSubsequence = "subsequence"
+	// PrereqAny requires every path of the chain in any order
+	PrereqAny = "any"
+)
+
+// DefaultPrereqCookie is the session cookie issued for prereq chains when prereq_options.cookie is not set
+const DefaultPrereqCookie = "sid"
+
+// PrereqOptions changes how the prereq chain is matched
+type PrereqOptions struct {
+	// Track is ip, cookie or both. Chains tracked by cookie survive IP
+	// changes, such as through a NAT pool. Both accepts a chain from either.
+	// The default is ip. Chains tracked by cookie can't be global conditions
+	Track string `yaml:"track,omitempty"`
+	// Order is strict, subsequence or any. The default is strict. Subsequence
+	// and any chains look at the latest 256 hits of a client
+	Order string `yaml:"order,omitempty"`
+	// MaxAge is the longest time between the first step and the request, such
+	// as 10m. When every chain has one, hits are kept for the longest of them.
+	// Otherwise hits are kept indefinitely
+	MaxAge string `yaml:"max_age,omitempty"`
+	// MinDelay is the shortest time between steps, including the request, such as 2s
+	MinDelay string `yaml:"min_delay,omitempty"`
+	// Cookie is the name of the session cookie issued by the steps of the chain
+	Cookie string `yaml:"cookie,omitempty"`
+}
+
+// Validate ensures the options are known and the durations can be parsed
+func (o PrereqOptions) Validate() error {
+	switch o.track() {
+	case PrereqTrackIP, PrereqTrackCookie, PrereqTrackBoth:
+	default:
+		return errors.New(fmt.Sprintf("%s is not a valid prereq track", o.Track))
+	}
+	switch o.order() {
+	case PrereqStrict, PrereqSubsequence, PrereqAny:
+	default:
+		return errors.New(fmt.Sprintf("%s is not a valid prereq order", o.Order))
+	}
+	for _, d := range []string{o.MaxAge, o.MinDelay} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return errors.Wrapf(err, "%s is not a valid duration", d)
+		}
+	}
+	return nil
+}
+
+func (o PrereqOptions) track() string {
+	if o.Track == "" {
+		return PrereqTrackIP
+	}
+	return strings.ToLower(o.Track)
+}
+
+func (o PrereqOptions) order() string {
+	if o.Order == "" {
+		return PrereqStrict
+	}
+	return strings.ToLower(o.Order)
+}
+
+func (o PrereqOptions) cookie() string {
+	if o.Cookie != "" {
+		return o.Cookie
+	}
+	return DefaultPrereqCookie
+}
+
+// tracksCookie checks if the chain is tracked by a session cookie
+func (o PrereqOptions) tracksCookie() bool {
+	return o.track() == PrereqTrackCookie || o.track() == PrereqTrackBoth
+}
+
+// duration parses d, which is zero when empty
+func duration(d string) time.Duration {
+	parsed, _ := time.ParseDuration(d)
+	return parsed
+}
+
+// matchChain checks if the hits of a client, oldest first, complete the
+// chain. Steps may be no older than maxAge, when set, and at least minDelay
+// apart from each other and from the request at t
+func matchChain(hits []clientHit, chain []string, order string, maxAge, minDelay time.Duration, t time.Time) bool {
+	if len(chain) == 0 {
+		return true
+	}
+
+	var times []time.Time
+	switch order {
+	case PrereqStrict:
+		if len(chain) > len(hits) {
+			return false
+		}
+		tail := hits[len(hits)-len(chain):]
+		for i := range tail {
+			if tail[i].path != chain[i] {
+				return false
+			}
+			times = append(times, tail[i].at)
+		}
+	case PrereqSubsequence:
+		// Take the latest hit of each step which leaves room for the delay,
+		// which leaves the most room for the steps before it
+		prev := t
+		j := len(hits) - 1
+		times = make([]time.Time, len(chain))
+		for i := len(chain) - 1; i >= 0; i-- {
+			found := false
+			for ; j >= 0; j-- {
+				h := hits[j]
+				if h.path == chain[i] && prev.Sub(h.at) >= minDelay {
+					times[i] = h.at
+					prev = h.at
+					found = true
+					j--
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	case PrereqAny:
+		// Take the latest hits of each step
+		need := make(map[string]int)
+		for _, p := range chain {
+			need[p]++
+		}
+		for j := len(hits) - 1; j >= 0 && len(times) < len(chain); j-- {
+			if need[hits[j].path] > 0 {
+				need[hits[j].path]--
+				times = append(times, hits[j].at)
+			}
+		}
+		if len(times) < len(chain) {
+			return false
+		}
+		sort.Slice(times, func(a, b int) bool { return times[a].Before(times[b]) })
+	default:
+		return false
+	}
+
+	if maxAge > 0 && t.Sub(times[0]) > maxAge {
+		return false
+	}
+	times = append(times, t)
+	for i := 1; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) < minDelay {
+			return false
+		}
+	}
+	return true
+}
+
+// matchChain checks if the client identified by key completed the chain
+func (c *RequestConditions) matchChain(state *State, key string) bool {
+	o := c.PrereqOptions
+	hits := state.pathIdentifier.hits(key)
+	return matchChain(hits, c.PrereqPaths, o.order(), duration(o.MaxAge), duration(o.MinDelay), now())
+}
+
+func (c *RequestConditions) prereqMatch(req *http.Request, state *State) bool {
+	if len(c.PrereqPaths) == 0 {
+		return true
+	}
+
+	o := c.PrereqOptions
+	filledPrereq := false
+	if o.track() != PrereqTrackCookie {
+		filledPrereq = c.matchChain(state, ipKey(util.GetHost(req)))
+	}
+	if !filledPrereq && o.tracksCookie() {
+		if cookie, err := req.Cookie(o.cookie()); err == nil && cookie.Value != "" {
+			filledPrereq = c.matchChain(state, sessionKey(cookie.Value))
+		}
+	}
+
+	if filledPrereq {
+		log.WithFields(log.Fields{
+			"prereqs": c.PrereqPaths,
+			"track":   o.track(),
+			"order":   o.order(),
+		}).Debug("Matched prerequisites")
+	} else {
+		log.WithFields(log.Fields{
+			"prereqs": c.PrereqPaths,
+			"track":   o.track(),
+			"order":   o.order(),
+		}).Debug("Did not match prerequisites")
+	}
+
+	return filledPrereq
+}
+
+// conditionChains returns the conditions with a prereq chain, from the
+// conditions and their nested blocks
+func conditionChains(c RequestConditions) []RequestConditions {
+	var chains []RequestConditions
+	if len(c.PrereqPaths) != 0 {
+		chains = append(chains, c)
+	}
+	for _, blocks := range [][]RequestConditions{c.AllOf, c.AnyOf, c.Not} {
+		for _, b := range blocks {
+			chains = append(chains, conditionChains(b)...)
+		}
+	}
+	return chains
+}
+
+// prereqChains returns the prereq chains of the path list
+func prereqChains(pathList []*Path) []RequestConditions {
+	var chains []RequestConditions
+	for _, p := range pathList {
+		chains = append(chains, conditionChains(p.Conditions)...)
+	}
+	return chains
+}
+
+// prereqSessions finds the session cookies of the prereq chains tracked by
+// cookie, and the steps which issue them
+func prereqSessions(pathList []*Path) (map[string]bool, map[string][]string) {
+	cookies := make(map[string]bool)
+	steps := make(map[string][]string)
+	for _, c := range prereqChains(pathList) {
+		if !c.PrereqOptions.tracksCookie() {
+			continue
+		}
+		name := c.PrereqOptions.cookie()
+		cookies[name] = true
+		for _, step := range c.PrereqPaths {
+			steps[step] = append(steps[step], name)
+		}
+	}
+	return cookies, steps
+}
+
+// prereqRetention is how long client hits are kept: the longest max_age of
+// the prereq chains, or zero to keep them indefinitely when a chain has none
+func prereqRetention(pathList []*Path) time.Duration {
+	var retention time.Duration
+	for _, c := range prereqChains(pathList) {
+		maxAge := duration(c.PrereqOptions.MaxAge)
+		if maxAge == 0 {
+			return 0
+		}
+		if maxAge > retention {
+			retention = maxAge
+		}
+	}
+	return retention
+}
+
+// newSession creates a random session ID
+func newSession() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessions returns the session cookies of prereq chains and the steps which issue them
+func (paths *Paths) sessions() (map[string]bool, map[string][]string) {
+	paths.sessionMu.RLock()
+	defer paths.sessionMu.RUnlock()
+	return paths.sessionCookies, paths.sessionSteps
+}
+
+// trackSession records a served request under its session cookies, and
+// issues the cookies when the path is a step of a chain tracked by cookie
+// and the client has no session issued by satellite
+func (paths *Paths) trackSession(w http.ResponseWriter, req *http.Request) {
+	uri := req.URL.Path
+	clients := paths.state.pathIdentifier
+	cookies, steps := paths.sessions()
+
+	issued := make(map[string]bool)
+	for _, name := range steps[uri] {
+		if issued[name] {
+			continue
+		}
+		if cookie, err := req.Cookie(name); err == nil && clients.HasSession(cookie.Value) {
+			continue
+		}
+		session, err := clients.IssueSession(uri)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Unable to create session")
+			continue
+		}
+		http.SetCookie(w, &http.Cookie{Name: name, Value: session, Path: "/", HttpOnly: true, Secure: req.TLS != nil})
+		issued[name] = true
+	}
+
+	for name := range cookies {
+		if issued[name] {
+			continue
+		}
+		if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+			clients.HitSession(cookie.Value, uri)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package path_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+// shouldHostPrereq hits each of the steps from one IP, sleeping for delay
+// between them, then checks the conditions in data for /target
+func shouldHostPrereq(t *testing.T, data string, delay time.Duration, steps ...string) bool {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	for _, step := range steps {
+		req := httptest.NewRequest("GET", step, nil)
+		req.RemoteAddr = "198.51.100.1:1234"
+		if err := state.Hit(req); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(delay)
+	}
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	req := httptest.NewRequest("GET", "/target", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	return conditions.ShouldHost(req, state, geoip.DB{})
+}
+
+const prereqChain = `
+prereq: [/one, /two]
+`
+
+func TestRequestConditions_ShouldHost_prereq_strict_favicon(t *testing.T) {
+	if shouldHostPrereq(t, prereqChain, 0, "/one", "/favicon.ico", "/two") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_subsequence(t *testing.T) {
+	data := prereqChain + "prereq_options: {order: subsequence}"
+	if !shouldHostPrereq(t, data, 0, "/one", "/favicon.ico", "/two", "/favicon.ico") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_subsequence_order(t *testing.T) {
+	data := prereqChain + "prereq_options: {order: subsequence}"
+	if shouldHostPrereq(t, data, 0, "/two", "/favicon.ico", "/one") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_any(t *testing.T) {
+	data := prereqChain + "prereq_options: {order: any}"
+	if !shouldHostPrereq(t, data, 0, "/two", "/favicon.ico", "/one") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_any_missing(t *testing.T) {
+	data := prereqChain + "prereq_options: {order: any}"
+	if shouldHostPrereq(t, data, 0, "/two", "/two") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_max_age(t *testing.T) {
+	data := prereqChain + "prereq_options: {max_age: 100ms}"
+	if shouldHostPrereq(t, data, 80*time.Millisecond, "/one", "/two") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_min_delay_replay(t *testing.T) {
+	data := prereqChain + "prereq_options: {min_delay: 50ms}"
+	if shouldHostPrereq(t, data, 0, "/one", "/two") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_prereq_min_delay(t *testing.T) {
+	data := prereqChain + "prereq_options: {min_delay: 50ms, max_age: 1m}"
+	if !shouldHostPrereq(t, data, 60*time.Millisecond, "/one", "/two") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_prereq_options_bad(t *testing.T) {
+	for _, data := range []string{
+		"prereq_options: {track: asn}",
+		"prereq_options: {order: random}",
+		"prereq_options: {max_age: soon}",
+	} {
+		if _, err := NewRequestConditions([]byte(data)); err == nil {
+			t.Errorf("%s is valid", data)
+		}
+	}
+}
+
+// sessionPaths serves /step.html, which issues the session cookie, and
+// /index.html, which needs /step.html first
+func sessionPaths(t *testing.T, track string) (*Paths, func()) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	serverRoot.CreateIndexFile()
+	serverRoot.CreateFile("step.html", "step")
+	serverRoot.CreatePathList(`- path: /step.html
+  hosted_file: /step.html
+- path: /index.html
+  hosted_file: /index.html
+  prereq: [/step.html]
+  prereq_options:
+    track: ` + track)
+
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+	return paths, func() { serverRoot.Close() }
+}
+
+func sessionRequest(t *testing.T, paths *Paths, uri, remoteAddr string, cookies []*http.Cookie) (bool, []*http.Cookie) {
+	req := httptest.NewRequest("GET", uri, nil)
+	req.RemoteAddr = remoteAddr
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	served, err := paths.MatchAndServe(w, req)
+	if err != nil {
+		t.Error(err)
+	}
+	return served, w.Result().Cookies()
+}
+
+func TestPaths_MatchAndServe_prereq_cookie(t *testing.T) {
+	paths, closer := sessionPaths(t, "cookie")
+	defer closer()
+
+	_, cookies := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", nil)
+	if len(cookies) != 1 || cookies[0].Name != DefaultPrereqCookie || !cookies[0].HttpOnly {
+		t.Fatalf("session cookie was not issued: %v", cookies)
+	}
+
+	// The IP changed, but the session is the same
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.2:1", cookies); !served {
+		t.Error("session was not served")
+	}
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.1:1", nil); served {
+		t.Error("IP without session was served")
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_cookie_reissue(t *testing.T) {
+	paths, closer := sessionPaths(t, "cookie")
+	defer closer()
+
+	_, cookies := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", nil)
+	if _, again := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", cookies); len(again) != 0 {
+		t.Errorf("session cookie was issued again: %v", again)
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_cookie_not_issued(t *testing.T) {
+	paths, closer := sessionPaths(t, "cookie")
+	defer closer()
+
+	chosen := []*http.Cookie{{Name: DefaultPrereqCookie, Value: "chosen-by-client"}}
+	_, cookies := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", chosen)
+	if len(cookies) != 1 || cookies[0].Value == "chosen-by-client" {
+		t.Errorf("session cookie was not issued: %v", cookies)
+	}
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.2:1", chosen); served {
+		t.Error("session chosen by the client was served")
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_both(t *testing.T) {
+	paths, closer := sessionPaths(t, "both")
+	defer closer()
+
+	_, cookies := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", nil)
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.1:1", nil); !served {
+		t.Error("IP was not served")
+	}
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.2:1", cookies); !served {
+		t.Error("session was not served")
+	}
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.3:1", nil); served {
+		t.Error("new client was served")
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_ip(t *testing.T) {
+	paths, closer := sessionPaths(t, "ip")
+	defer closer()
+
+	_, cookies := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", nil)
+	if len(cookies) != 0 {
+		t.Errorf("session cookie was issued: %v", cookies)
+	}
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.2:1", nil); served {
+		t.Error("other IP was served")
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_single_hit(t *testing.T) {
+	paths, closer := sessionPaths(t, "ip")
+	defer closer()
+
+	// The prereq of /index.html is only merged once, so one hit of
+	// /step.html is enough
+	sessionRequest(t, paths, "/step.html", "198.51.100.1:1", nil)
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.1:1", nil); !served {
+		t.Error("single hit of the prereq was not served")
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_cookie_nested(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+	serverRoot.CreateFile("step.html", "step")
+	serverRoot.CreatePathList(`- path: /step.html
+  hosted_file: /step.html
+- path: /index.html
+  hosted_file: /index.html
+  any_of:
+    - prereq: [/step.html]
+      prereq_options:
+        track: cookie`)
+
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, cookies := sessionRequest(t, paths, "/step.html", "198.51.100.1:1", nil)
+	if len(cookies) != 1 {
+		t.Fatalf("session cookie was not issued: %v", cookies)
+	}
+	if served, _ := sessionRequest(t, paths, "/index.html", "198.51.100.2:1", cookies); !served {
+		t.Error("session was not served")
+	}
+}
+
+func TestPaths_MatchAndServe_prereq_cookie_global(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+
+	condsRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer condsRoot.Close()
+	condsRoot.CreateFile("prereq.yml", "prereq: [/step.html]\nprereq_options:\n  track: cookie\n")
+
+	paths, err := NewDefault(serverRoot.Path, condsRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := paths.MatchAndServe(httptest.NewRecorder(), httptest.NewRequest("GET", "/index.html", nil)); err == nil {
+		t.Fail()
+	}
+}
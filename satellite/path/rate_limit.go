@@ -0,0 +1,246 @@
+package path
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// Clients a rate limit can count requests per
+const (
+	RatePerIP     = "ip"
+	RatePerSubnet = "subnet"
+	RatePerJA3    = "ja3"
+)
+
+// RateLimit allows a number of requests per window for each client. Every
+// request checking the conditions is counted once, whether it is served or
+// not and however many times the rate limit is evaluated
+type RateLimit struct {
+	// Requests is the number of requests allowed in a window
+	Requests uint64 `yaml:"requests"`
+	// Window is the length of the window, such as 1m
+	Window string `yaml:"window"`
+	// Per is what requests are counted per: ip, subnet (/24 for IPv4 and /64
+	// for IPv6) or ja3. The default is ip
+	Per string `yaml:"per,omitempty"`
+}
+
+// Validate ensures the window can be parsed and the client is known
+func (r RateLimit) Validate() error {
+	if r.Requests == 0 {
+		return errors.New("rate limit needs requests")
+	}
+	if _, err := time.ParseDuration(r.Window); err != nil {
+		return errors.Wrapf(err, "%s is not a valid window", r.Window)
+	}
+	if !validClient(r.per()) {
+		return errors.New(fmt.Sprintf("%s is not a valid rate limit client", r.Per))
+	}
+	return nil
+}
+
+func (r RateLimit) per() string {
+	if r.Per == "" {
+		return RatePerIP
+	}
+	return strings.ToLower(r.Per)
+}
+
+// client returns the identifier of the client of req for the rate limit
+func (r RateLimit) client(req *http.Request) string {
+	return clientIdentifier(req, r.per())
+}
+
+// key returns the limiter key of the client of req and the window, or false
+// when the client can't be identified
+func (r RateLimit) key(req *http.Request) (string, time.Duration, bool) {
+	client := r.client(req)
+	if client == "" {
+		return "", 0, false
+	}
+	window, err := time.ParseDuration(r.Window)
+	if err != nil {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%d/%s/%s/%s", r.Requests, window, r.per(), client), window, true
+}
+
+// validClient checks if per is a client requests can be counted per
+func validClient(per string) bool {
+	switch per {
+	case RatePerIP, RatePerSubnet, RatePerJA3:
+		return true
+	}
+	return false
+}
+
+// clientIdentifier identifies the client of req by its IP, subnet or JA3N
+func clientIdentifier(req *http.Request, per string) string {
+	switch per {
+	case RatePerIP:
+		if ip := util.GetHost(req); ip != nil {
+			return ip.String()
+		}
+	case RatePerSubnet:
+		ip := util.GetHost(req)
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		if ip != nil {
+			return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+		}
+	case RatePerJA3:
+		if req.JA3Fingerprint != "" {
+			return ja3Key(req.JA3Fingerprint)
+		}
+	}
+	return ""
+}
+
+// RateLimiter counts requests in fixed windows. It is safe for concurrent use
+type RateLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]rateWindow
+	nextSweep time.Time
+}
+
+type rateWindow struct {
+	count   uint64
+	expires time.Time
+}
+
+// NewRateLimiter creates an empty limiter
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{windows: make(map[string]rateWindow)}
+}
+
+// Allow counts a request for key and checks if it is within limit requests
+// per window. It returns the number of requests in the current window
+func (l *RateLimiter) Allow(key string, limit uint64, window time.Duration) (bool, uint64) {
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(t)
+
+	w, ok := l.windows[key]
+	if !ok || !t.Before(w.expires) {
+		w = rateWindow{expires: t.Add(window)}
+	}
+	w.count++
+	l.windows[key] = w
+
+	return w.count <= limit, w.count
+}
+
+// Count returns the number of requests for key in the current window
+func (l *RateLimiter) Count(key string) uint64 {
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.windows[key]
+	if !ok || !t.Before(w.expires) {
+		return 0
+	}
+	return w.count
+}
+
+// sweep removes expired windows, at most once a minute
+func (l *RateLimiter) sweep(t time.Time) {
+	if t.Before(l.nextSweep) {
+		return
+	}
+	for key, w := range l.windows {
+		if !t.Before(w.expires) {
+			delete(l.windows, key)
+		}
+	}
+	l.nextSweep = t.Add(time.Minute)
+}
+
+func (c *RequestConditions) validateRateLimits() error {
+	for i, r := range c.RateLimit {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "rate_limit[%d]", i)
+		}
+	}
+	return nil
+}
+
+// conditionRateLimits returns the rate limits of the conditions and their
+// nested blocks
+func conditionRateLimits(c RequestConditions) []RateLimit {
+	limits := append([]RateLimit(nil), c.RateLimit...)
+	for _, blocks := range [][]RequestConditions{c.AllOf, c.AnyOf, c.Not} {
+		for _, b := range blocks {
+			limits = append(limits, conditionRateLimits(b)...)
+		}
+	}
+	return limits
+}
+
+// countRateLimits counts the request for every rate limit of the conditions,
+// including the ones in nested blocks. Merged conditions and blocks may
+// repeat a limit, which must only be counted once
+func (c *RequestConditions) countRateLimits(req *http.Request, state *State) {
+	seen := make(map[RateLimit]bool)
+	for _, r := range conditionRateLimits(*c) {
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+
+		if key, window, ok := r.key(req); ok {
+			state.limiter.Allow(key, r.Requests, window)
+		}
+	}
+}
+
+// rateLimit checks the requests counted by countRateLimits against the limits
+func (c *RequestConditions) rateLimit(req *http.Request, state *State) bool {
+	if len(c.RateLimit) == 0 {
+		log.Trace("No rate limit")
+		return true
+	}
+
+	for _, r := range c.RateLimit {
+		key, _, ok := r.key(req)
+		if !ok {
+			log.WithFields(log.Fields{
+				"per": r.per(),
+			}).Debug("No client for rate limit")
+			return false
+		}
+
+		count := state.limiter.Count(key)
+		if count > r.Requests {
+			log.WithFields(log.Fields{
+				"per":      r.per(),
+				"client":   r.client(req),
+				"requests": count,
+				"limit":    r.Requests,
+				"window":   r.Window,
+			}).Debug("Client exceeds rate limit")
+			return false
+		}
+		log.WithFields(log.Fields{
+			"per":      r.per(),
+			"client":   r.client(req),
+			"requests": count,
+			"limit":    r.Requests,
+		}).Trace("Client within rate limit")
+	}
+
+	return true
+}
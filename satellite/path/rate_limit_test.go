@@ -0,0 +1,207 @@
+package path_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+// rateLimited counts how many of the requests from each address are hosted
+func rateLimited(t *testing.T, data string, remoteAddrs ...string) int {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+
+	hosted := 0
+	for _, addr := range remoteAddrs {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if conditions.ShouldHost(req, state, geoip.DB{}) {
+			hosted++
+		}
+	}
+	return hosted
+}
+
+func TestRequestConditions_ShouldHost_rate_limit_ip(t *testing.T) {
+	data := "rate_limit: [{requests: 2, window: 1m}]"
+	if hosted := rateLimited(t, data, "198.51.100.1:1", "198.51.100.1:2", "198.51.100.1:3", "198.51.100.2:1"); hosted != 3 {
+		t.Errorf("hosted %d requests", hosted)
+	}
+}
+
+func TestRequestConditions_ShouldHost_rate_limit_subnet(t *testing.T) {
+	data := "rate_limit: [{requests: 2, window: 1m, per: subnet}]"
+	if hosted := rateLimited(t, data, "198.51.100.1:1", "198.51.100.2:1", "198.51.100.3:1", "203.0.113.1:1"); hosted != 3 {
+		t.Errorf("hosted %d requests", hosted)
+	}
+}
+
+func TestRequestConditions_ShouldHost_rate_limit_subnet_ipv6(t *testing.T) {
+	data := "rate_limit: [{requests: 1, window: 1m, per: subnet}]"
+	if hosted := rateLimited(t, data, "[2001:db8::1]:1", "[2001:db8::2]:1", "[2001:db8:1::1]:1"); hosted != 2 {
+		t.Errorf("hosted %d requests", hosted)
+	}
+}
+
+func TestRequestConditions_ShouldHost_rate_limit_nested(t *testing.T) {
+	// Both any_of blocks check the limit, but each request is counted once
+	data := `
+any_of:
+  - rate_limit: [{requests: 2, window: 1m}]
+    authorized_methods: [POST]
+  - rate_limit: [{requests: 2, window: 1m}]`
+	if hosted := rateLimited(t, data, "198.51.100.1:1", "198.51.100.1:2", "198.51.100.1:3"); hosted != 2 {
+		t.Errorf("hosted %d requests", hosted)
+	}
+}
+
+func TestRequestConditions_ShouldHost_rate_limit_window(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("rate_limit: [{requests: 1, window: 50ms}]"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if !conditions.ShouldHost(req, state, geoip.DB{}) {
+		t.Error("first request was not hosted")
+	}
+	if conditions.ShouldHost(req, state, geoip.DB{}) {
+		t.Error("second request was hosted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !conditions.ShouldHost(req, state, geoip.DB{}) {
+		t.Error("request after the window was not hosted")
+	}
+}
+
+func TestRequestConditions_ShouldHost_rate_limit_ja3(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("rate_limit: [{requests: 1, window: 1m, per: ja3}]"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	first := httptest.NewRequest("GET", "/", nil)
+	first.RemoteAddr = "198.51.100.1:1"
+	first.JA3Fingerprint = "771,4865-4866,0-23-65281-10,29-23,0"
+	second := httptest.NewRequest("GET", "/", nil)
+	second.RemoteAddr = "198.51.100.2:1"
+	second.JA3Fingerprint = "771,4865-4866,0-23-65281-10,29-23,0"
+
+	if !conditions.ShouldHost(first, state, geoip.DB{}) {
+		t.Error("first request was not hosted")
+	}
+	if conditions.ShouldHost(second, state, geoip.DB{}) {
+		t.Error("second request was hosted")
+	}
+}
+
+func TestNewRequestConditions_rate_limit_bad(t *testing.T) {
+	for _, data := range []string{
+		"rate_limit: [{requests: 1, window: soon}]",
+		"rate_limit: [{requests: 1, window: 1m, per: asn}]",
+		"rate_limit: [{window: 1m}]",
+	} {
+		if _, err := NewRequestConditions([]byte(data)); err == nil {
+			t.Errorf("%s is valid", data)
+		}
+	}
+}
+
+func TestRateLimiter_Allow_concurrent(t *testing.T) {
+	limiter := NewRateLimiter()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := limiter.Allow("client", 10, time.Minute); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("allowed %d requests", allowed)
+	}
+}
+
+func TestPaths_MatchAndServe_rate_limit_global(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+	serverRoot.CreateFile("other.html", Sentinal)
+	serverRoot.CreatePathList(`- path: /index.html
+  hosted_file: /index.html
+- path: /other.html
+  hosted_file: /other.html
+  rate_limit:
+    - requests: 1
+      window: 1m`)
+
+	condsRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer condsRoot.Close()
+	condsRoot.CreateFile("limit.yml", "rate_limit: [{requests: 3, window: 1m}]")
+
+	paths, err := NewDefault(serverRoot.Path, condsRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The global limit is shared by both paths and the path limit only applies to /other.html
+	expected := []struct {
+		uri    string
+		served bool
+	}{
+		{"/other.html", true},
+		{"/other.html", false},
+		{"/index.html", true},
+		{"/index.html", false},
+	}
+	for i, e := range expected {
+		req := httptest.NewRequest("GET", e.uri, nil)
+		w := httptest.NewRecorder()
+		served, err := paths.MatchAndServe(w, req)
+		if err != nil {
+			t.Error(err)
+		}
+		if served != e.served {
+			t.Errorf("request %d to %s served: %v", i, e.uri, served)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package path
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// rdnsFailureTTL is the longest a failed lookup is cached, so clients whose
+// lookups time out don't wait for the timeout on every request
+const rdnsFailureTTL = 30 * time.Second
+
+// RDNSResolver looks up forward-confirmed reverse DNS hostnames and caches the results
+type RDNSResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	cache     map[string]rdnsEntry
+	nextSweep time.Time
+}
+
+type rdnsEntry struct {
+	names   []string
+	failed  bool
+	expires time.Time
+}
+
+// NewRDNSResolver creates a resolver which queries the DNS server at address,
+// such as 127.0.0.1:53, or the system resolver when address is empty. Each
+// lookup is limited to timeout and its result is cached for ttl. Failed lookups,
+// such as ones timing out, are cached for at most 30 seconds
+func NewRDNSResolver(address string, timeout, ttl time.Duration) *RDNSResolver {
+	resolver := net.DefaultResolver
+	if address != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		}
+	}
+
+	return &RDNSResolver{
+		resolver: resolver,
+		timeout:  timeout,
+		ttl:      ttl,
+		cache:    make(map[string]rdnsEntry),
+	}
+}
+
+// Lookup returns the lowercase PTR hostnames of ip which resolve back to ip,
+// and false when the lookup failed, so the hostnames of ip are unknown
+func (r *RDNSResolver) Lookup(ip net.IP) ([]string, bool) {
+	if ip == nil {
+		return nil, false
+	}
+	key := ip.String()
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now().Before(entry.expires) {
+		return entry.names, !entry.failed
+	}
+
+	names, ok := r.lookup(ip)
+	ttl := r.ttl
+	if !ok && ttl > rdnsFailureTTL {
+		ttl = rdnsFailureTTL
+	}
+
+	t := now()
+	r.mu.Lock()
+	r.sweep(t)
+	r.cache[key] = rdnsEntry{names: names, failed: !ok, expires: t.Add(ttl)}
+	r.mu.Unlock()
+
+	return names, ok
+}
+
+// sweep removes expired entries, at most once a minute
+func (r *RDNSResolver) sweep(t time.Time) {
+	if t.Before(r.nextSweep) {
+		return
+	}
+	for key, entry := range r.cache {
+		if !t.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+	r.nextSweep = t.Add(time.Minute)
+}
+
+// lookup returns the confirmed hostnames of ip and if the lookup succeeded.
+// A name which does not exist is an answer, while timeouts and server failures
+// are not
+func (r *RDNSResolver) lookup(ip net.IP) ([]string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	ptrs, err := r.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"ip":    ip.String(),
+			"error": err,
+		}).Debug("Reverse DNS lookup failed")
+		return nil, answeredDNSError(err)
+	}
+
+	var names []string
+	answered := true
+	for _, ptr := range ptrs {
+		addrs, err := r.resolver.LookupIPAddr(ctx, ptr)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"hostname": ptr,
+				"error":    err,
+			}).Debug("Forward DNS lookup failed")
+			answered = answered && answeredDNSError(err)
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				names = append(names, strings.ToLower(strings.TrimSuffix(ptr, ".")))
+				break
+			}
+		}
+	}
+
+	return names, answered
+}
+
+// answeredDNSError is true when the error is an answer from the DNS server,
+// such as the name not existing, rather than a failure to get one
+func answeredDNSError(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.Timeout() && !dnsErr.Temporary()
+}
+
+// AddRDNS sets the DNS server reverse DNS conditions query, such as
+// 127.0.0.1:53, or the system resolver when address is empty
+func (paths *Paths) AddRDNS(address string, timeout, ttl time.Duration) {
+	paths.state.SetRDNS(NewRDNSResolver(address, timeout, ttl))
+}
+
+// matchHostnames returns the first hostname matching one of the globs
+func matchHostnames(globs, names []string) (string, string, bool) {
+	for _, pattern := range globs {
+		g := glob.MustCompile(strings.ToLower(pattern))
+		for _, name := range names {
+			if g.Match(name) {
+				return pattern, name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func (c *RequestConditions) authorizedRDNSGlob(req *http.Request, state *State) bool {
+	if len(c.AuthorizedRDNSGlob) == 0 {
+		log.Trace("No authorized reverse DNS globs")
+		return true
+	}
+
+	names, _ := state.rdns.Lookup(util.GetHost(req))
+	if pattern, name, ok := matchHostnames(c.AuthorizedRDNSGlob, names); ok {
+		log.WithFields(log.Fields{
+			"target_rdns": pattern,
+			"rdns":        name,
+		}).Debug("Matched authorized reverse DNS")
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"rdns": names,
+	}).Debug("Did not match authorized reverse DNS")
+	return false
+}
+
+func (c *RequestConditions) blacklistRDNSGlob(req *http.Request, state *State) bool {
+	if len(c.BlacklistRDNSGlob) == 0 {
+		log.Trace("No blacklisted reverse DNS globs")
+		return true
+	}
+
+	names, answered := state.rdns.Lookup(util.GetHost(req))
+	if pattern, name, ok := matchHostnames(c.BlacklistRDNSGlob, names); ok {
+		log.WithFields(log.Fields{
+			"target_rdns": pattern,
+			"rdns":        name,
+		}).Debug("Matched blacklisted reverse DNS")
+		return false
+	}
+
+	// Scanners could slow down their resolver to get past the blacklist
+	if !answered {
+		log.WithFields(log.Fields{
+			"rdns": names,
+		}).Debug("Reverse DNS lookup failed for blacklisted reverse DNS")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"rdns": names,
+	}).Trace("Did not match blacklisted reverse DNS")
+	return true
+}
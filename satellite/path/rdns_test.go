@@ -0,0 +1,272 @@
+package path_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+// stubDNS answers PTR and A queries from fixed records over UDP
+type stubDNS struct {
+	conn    net.PacketConn
+	ptr     map[string]string
+	a       map[string]net.IP
+	queries int32
+}
+
+func newStubDNS(t *testing.T, ptr map[string]string, a map[string]net.IP) *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubDNS{conn: conn, ptr: ptr, a: a}
+	go s.serve()
+	return s
+}
+
+func (s *stubDNS) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubDNS) Close() {
+	s.conn.Close()
+}
+
+func (s *stubDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// Read the question name
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1 : i+3])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	atomic.AddInt32(&s.queries, 1)
+
+	var rdata []byte
+	var rtype uint16
+	switch qtype {
+	case 12:
+		if host, ok := s.ptr[name]; ok {
+			rtype, rdata = 12, encodeName(host)
+		}
+	case 1:
+		if ip, ok := s.a[name]; ok {
+			rtype, rdata = 1, ip.To4()
+		}
+	}
+
+	resp := make([]byte, 12)
+	copy(resp, query[:2])
+	flags := uint16(0x8180)
+	if rdata == nil && qtype == 12 {
+		flags |= 3
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, question...)
+	if rdata != nil {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xc0, 12)
+		resp = append(resp, byte(rtype>>8), byte(rtype), 0, 1, 0, 0, 0, 60)
+		resp = append(resp, byte(len(rdata)>>8), byte(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func withStubDNS(t *testing.T) (*stubDNS, *RDNSResolver) {
+	s := newStubDNS(t, map[string]string{
+		"9.113.0.203.in-addr.arpa":  "scanner.example.com",
+		"10.113.0.203.in-addr.arpa": "spoofed.example.com",
+	}, map[string]net.IP{
+		"scanner.example.com": net.ParseIP("203.0.113.9"),
+		"spoofed.example.com": net.ParseIP("192.0.2.1"),
+	})
+	return s, NewRDNSResolver(s.Addr(), time.Second, time.Minute)
+}
+
+func shouldHostRDNS(t *testing.T, r *RDNSResolver, remoteAddr, data string) bool {
+	mockRequest := &http.Request{RemoteAddr: remoteAddr}
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+	state.SetRDNS(r)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, geoip.DB{})
+}
+
+func TestRDNSResolver_Lookup(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	names, ok := r.Lookup(net.ParseIP("203.0.113.9"))
+	if !ok || len(names) != 1 || names[0] != "scanner.example.com" {
+		t.Error(names)
+	}
+}
+
+func TestRDNSResolver_Lookup_unconfirmed(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	// The PTR record doesn't resolve back to the address
+	if names, ok := r.Lookup(net.ParseIP("203.0.113.10")); !ok || len(names) != 0 {
+		t.Error(names)
+	}
+}
+
+func TestRDNSResolver_Lookup_cache(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	r.Lookup(net.ParseIP("203.0.113.9"))
+	queries := atomic.LoadInt32(&s.queries)
+	r.Lookup(net.ParseIP("203.0.113.9"))
+	if n := atomic.LoadInt32(&s.queries); n != queries {
+		t.Errorf("expected a cached result, got %d more queries", n-queries)
+	}
+}
+
+// withSilentDNS returns a resolver querying a socket which never answers
+func withSilentDNS(t *testing.T) (net.PacketConn, *RDNSResolver) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, NewRDNSResolver(conn.LocalAddr().String(), 100*time.Millisecond, time.Minute)
+}
+
+func TestRDNSResolver_Lookup_timeout(t *testing.T) {
+	conn, r := withSilentDNS(t)
+	defer conn.Close()
+
+	start := time.Now()
+	if names, ok := r.Lookup(net.ParseIP("203.0.113.9")); ok || len(names) != 0 {
+		t.Error(names)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("lookup did not time out")
+	}
+}
+
+func TestRDNSResolver_Lookup_timeout_cached(t *testing.T) {
+	conn, r := withSilentDNS(t)
+	defer conn.Close()
+
+	r.Lookup(net.ParseIP("203.0.113.9"))
+	start := time.Now()
+	if _, ok := r.Lookup(net.ParseIP("203.0.113.9")); ok {
+		t.Error("timed out lookup succeeded")
+	}
+	if time.Since(start) >= 100*time.Millisecond {
+		t.Error("timed out lookup was not cached")
+	}
+}
+
+func TestRDNSResolver_Lookup_notfound_cached(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	// The stub answers NXDOMAIN for addresses without a PTR record
+	r.Lookup(net.ParseIP("192.0.2.55"))
+	queries := atomic.LoadInt32(&s.queries)
+	r.Lookup(net.ParseIP("192.0.2.55"))
+	if n := atomic.LoadInt32(&s.queries); n != queries {
+		t.Errorf("expected a cached result, got %d more queries", n-queries)
+	}
+}
+
+func TestRequestConditions_ShouldHost_rdns_auth_succeed(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	if !shouldHostRDNS(t, r, "203.0.113.9:54321", "authorized_rdns_glob: ['*.example.com']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_rdns_auth_unconfirmed(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	if shouldHostRDNS(t, r, "203.0.113.10:54321", "authorized_rdns_glob: ['*.example.com']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_rdns_bl(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	if shouldHostRDNS(t, r, "203.0.113.9:54321", "blacklist_rdns_glob: ['SCANNER.*']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_rdns_bl_none(t *testing.T) {
+	s, r := withStubDNS(t)
+	defer s.Close()
+
+	if !shouldHostRDNS(t, r, "192.0.2.55:54321", "blacklist_rdns_glob: ['scanner.*']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_rdns_bl_timeout(t *testing.T) {
+	conn, r := withSilentDNS(t)
+	defer conn.Close()
+
+	if shouldHostRDNS(t, r, "203.0.113.9:54321", "blacklist_rdns_glob: ['scanner.*']") {
+		t.Fail()
+	}
+}
@@ -0,0 +1,218 @@
+package path
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// ClientTimezone is the TimeWindow timezone which uses the GeoIP timezone of the client
+const ClientTimezone = "client"
+
+// now is the clock used by the schedule conditions
+var now = time.Now
+
+var weekdays = map[string][]time.Weekday{
+	"sun":       {time.Sunday},
+	"mon":       {time.Monday},
+	"tue":       {time.Tuesday},
+	"wed":       {time.Wednesday},
+	"thu":       {time.Thursday},
+	"fri":       {time.Friday},
+	"sat":       {time.Saturday},
+	"sunday":    {time.Sunday},
+	"monday":    {time.Monday},
+	"tuesday":   {time.Tuesday},
+	"wednesday": {time.Wednesday},
+	"thursday":  {time.Thursday},
+	"friday":    {time.Friday},
+	"saturday":  {time.Saturday},
+	"weekdays":  {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends":  {time.Saturday, time.Sunday},
+}
+
+// TimeWindow is a recurring window of time, such as weekdays 08:00-18:00 in Europe/Berlin
+type TimeWindow struct {
+	// Days are the days the window opens on, such as mon, friday, weekdays or weekends. Every day when empty
+	Days []string `yaml:"days,omitempty"`
+	// Start is the time of day the window opens, such as 08:00
+	Start string `yaml:"start"`
+	// End is the time of day the window closes. A window which ends before it starts runs overnight
+	End string `yaml:"end"`
+	// Timezone is the IANA timezone of the window, UTC when empty. The client
+	// timezone uses the GeoIP timezone of the client for local business hours
+	Timezone string `yaml:"timezone,omitempty"`
+}
+
+// Validate ensures the days, times and timezone of the window can be parsed
+func (w TimeWindow) Validate() error {
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return errors.New(fmt.Sprintf("%s is not a valid day", d))
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	if w.Timezone != ClientTimezone {
+		if _, err := time.LoadLocation(w.Timezone); err != nil {
+			return errors.Wrapf(err, "%s is not a valid timezone", w.Timezone)
+		}
+	}
+	return nil
+}
+
+// Contains checks if the window is open at t, in the window's location
+func (w TimeWindow) Contains(t time.Time, loc *time.Location) bool {
+	t = t.In(loc)
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	day := t.Weekday()
+	open := clock >= start && clock < end
+	if end <= start {
+		// Overnight windows belong to the day they opened on
+		open = clock >= start || clock < end
+		if clock < end {
+			day = (day + 6) % 7
+		}
+	}
+
+	return open && w.onDay(day)
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		for _, wd := range weekdays[strings.ToLower(d)] {
+			if wd == day {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseClock parses a time of day such as 08:00 into the duration since midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s is not a valid time of day", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// validateSchedule ensures not_before, not_after and the schedule can be parsed
+func (c *RequestConditions) validateSchedule() error {
+	for _, ts := range []string{c.NotBefore, c.NotAfter} {
+		if ts == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, ts); err != nil {
+			return errors.Wrapf(err, "%s is not a valid RFC 3339 time", ts)
+		}
+	}
+	for i, w := range c.Schedule {
+		if err := w.Validate(); err != nil {
+			return errors.Wrapf(err, "schedule[%d]", i)
+		}
+	}
+	return nil
+}
+
+func (c *RequestConditions) timeRange(req *http.Request) bool {
+	t := now()
+
+	if c.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, c.NotBefore)
+		if err != nil || t.Before(notBefore) {
+			log.WithFields(log.Fields{
+				"not_before": c.NotBefore,
+			}).Debug("Request is before not_before")
+			return false
+		}
+	}
+
+	if c.NotAfter != "" {
+		notAfter, err := time.Parse(time.RFC3339, c.NotAfter)
+		if err != nil || t.After(notAfter) {
+			log.WithFields(log.Fields{
+				"not_after": c.NotAfter,
+			}).Debug("Request is after not_after")
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *RequestConditions) scheduleMatch(req *http.Request, gip geoip.DB) bool {
+	if len(c.Schedule) == 0 {
+		log.Trace("No schedule")
+		return true
+	}
+
+	t := now()
+	for _, w := range c.Schedule {
+		loc, err := windowLocation(w, req, gip)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"timezone": w.Timezone,
+				"error":    err,
+			}).Debug("Unable to find schedule timezone")
+			continue
+		}
+		if w.Contains(t, loc) {
+			log.WithFields(log.Fields{
+				"start":    w.Start,
+				"end":      w.End,
+				"timezone": loc.String(),
+			}).Debug("Matched schedule window")
+			return true
+		}
+		log.WithFields(log.Fields{
+			"start":    w.Start,
+			"end":      w.End,
+			"timezone": loc.String(),
+		}).Trace("Did not match schedule window")
+	}
+
+	return false
+}
+
+// windowLocation returns the location a window is evaluated in
+func windowLocation(w TimeWindow, req *http.Request, gip geoip.DB) (*time.Location, error) {
+	if w.Timezone != ClientTimezone {
+		return time.LoadLocation(w.Timezone)
+	}
+
+	if !gip.HasCity() {
+		return nil, errors.New("no GeoIP City database for client timezone")
+	}
+	tz, err := gip.TimeZone(util.GetHost(req))
+	if err != nil {
+		return nil, err
+	}
+	if tz == "" {
+		return nil, errors.New("client has no GeoIP timezone")
+	}
+	return time.LoadLocation(tz)
+}
@@ -0,0 +1,159 @@
+package path
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/geoip"
+)
+
+// Scoring turns conditions into weighted signals instead of hard requirements.
+//
+// A condition with a positive weight adds it when the condition passes, and a
+// condition with a negative weight adds it when the condition fails. The request
+// is served when the total is at least MinScore. Conditions without a weight
+// must still pass. Weighted conditions which aren't set, and GeoIP conditions
+// without their database, are left out of the score
+type Scoring struct {
+	// MinScore is the score needed to serve the request
+	MinScore int `yaml:"min_score,omitempty"`
+	// Weights are the weights of the conditions, by name
+	Weights map[string]int `yaml:"weights,omitempty"`
+}
+
+// Enabled is true when at least one condition is weighted
+func (s Scoring) Enabled() bool {
+	return len(s.Weights) > 0
+}
+
+// hardGates are conditions which must always pass, so they can't be weighted
+var hardGates = map[string]bool{
+	"not_serving":      true,
+	"serve":            true,
+	"serve_per_client": true,
+}
+
+// Validate ensures all weights belong to a condition which can be weighted
+// and that a minimum score comes with weights
+func (s Scoring) Validate() error {
+	if s.MinScore != 0 && !s.Enabled() {
+		return errors.New("min_score is set without weights")
+	}
+	names := make(map[string]bool)
+	for _, cond := range (&RequestConditions{}).conditions() {
+		names[cond.name] = true
+	}
+	for name := range s.Weights {
+		if !names[name] {
+			return errors.New(fmt.Sprintf("%s is not a valid condition", name))
+		}
+		if hardGates[name] {
+			return errors.New(fmt.Sprintf("%s can't be weighted", name))
+		}
+	}
+	return nil
+}
+
+// checkable is false for GeoIP conditions without the database they need
+func checkable(name string, gip geoip.DB) bool {
+	switch name {
+	case "geoip":
+		return gip.HasDB()
+	case "geoip_location":
+		return gip.HasCity()
+	case "asn":
+		return gip.HasASN()
+	}
+	return true
+}
+
+// ScoreResult is the outcome of a weighted condition
+type ScoreResult struct {
+	Condition string
+	Passed    bool
+	Weight    int
+	Points    int
+}
+
+// Score is the breakdown of the weighted conditions of a request
+type Score struct {
+	Total    int
+	MinScore int
+	Results  []ScoreResult
+}
+
+func (s *Score) add(name string, passed bool, weight int) {
+	result := ScoreResult{Condition: name, Passed: passed, Weight: weight}
+	if passed && weight > 0 || !passed && weight < 0 {
+		result.Points = weight
+	}
+	s.Total += result.Points
+	s.Results = append(s.Results, result)
+}
+
+// String formats the breakdown for logs, such as geoip=0 authorized_useragents=+2
+func (s Score) String() string {
+	results := make([]string, 0, len(s.Results))
+	for _, r := range s.Results {
+		results = append(results, fmt.Sprintf("%s=%+d", r.Condition, r.Points))
+	}
+	return strings.Join(results, " ")
+}
+
+// ShouldHostScore returns when an HTTP request should be hosted, along with the
+// score breakdown of the weighted conditions and the response override of the
+// exec and webhook conditions, if any. When no condition is weighted, every
+// condition must pass and the score is empty
+func (c *RequestConditions) ShouldHostScore(req *http.Request, state *State, gip geoip.DB) (bool, Score, *ExecResponse) {
+	c.countRateLimits(req, state)
+	return c.shouldHostScore(req, state, gip)
+}
+
+// shouldHostScore checks the conditions without counting the request for the
+// rate limits, so nested blocks don't count it again
+func (c *RequestConditions) shouldHostScore(req *http.Request, state *State, gip geoip.DB) (bool, Score, *ExecResponse) {
+	score := Score{MinScore: c.Scoring.MinScore}
+
+	// Response overrides are kept apart so only the ones agreeing with the
+	// decision are returned
+	var allowResp, denyResp *ExecResponse
+	for _, cond := range c.conditions() {
+		ok, condResp := cond.match(req, state, gip)
+		weight, scored := c.Scoring.Weights[cond.name]
+		// Conditions which aren't set or can't be checked pass without
+		// checking anything, so they don't earn their weight
+		scored = scored && cond.set && checkable(cond.name, gip)
+		if !scored && !ok {
+			return false, score, condResp
+		}
+		if condResp != nil {
+			if ok {
+				allowResp = condResp
+			} else {
+				denyResp = condResp
+			}
+		}
+		if scored {
+			score.add(cond.name, ok, weight)
+		}
+	}
+
+	if !c.Scoring.Enabled() {
+		return true, score, allowResp
+	}
+
+	shouldHost := score.Total >= score.MinScore
+	log.WithFields(log.Fields{
+		"score":     score.Total,
+		"min_score": score.MinScore,
+		"breakdown": score.String(),
+		"serve":     shouldHost,
+	}).Debug("Scored conditions")
+	if !shouldHost {
+		return false, score, denyResp
+	}
+	return true, score, allowResp
+}
@@ -0,0 +1,205 @@
+package path_test
+
+import (
+	"testing"
+
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+func shouldHostScore(t *testing.T, data string) (bool, Score) {
+	mockRequest := httptest.NewRequest("GET", "/", nil)
+	mockRequest.RemoteAddr = "203.0.113.7:4444"
+	mockRequest.Header.Set("User-Agent", "target")
+
+	db, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	ok, score, _ := conditions.ShouldHostScore(mockRequest, db, geoip.DB{})
+	return ok, score
+}
+
+func TestRequestConditions_ShouldHostScore_outscored(t *testing.T) {
+	data := `
+authorized_useragents: [target]
+authorized_methods: [POST]
+scoring:
+  min_score: 2
+  weights:
+    authorized_useragents: 2
+    authorized_methods: 1
+`
+	ok, score := shouldHostScore(t, data)
+	if !ok || score.Total != 2 || len(score.Results) != 2 {
+		t.Fail()
+	}
+	if score.String() != "authorized_useragents=+2 authorized_methods=+0" {
+		t.Error(score.String())
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_below_min(t *testing.T) {
+	data := `
+authorized_useragents: [other]
+authorized_methods: [GET]
+scoring:
+  min_score: 2
+  weights:
+    authorized_useragents: 2
+    authorized_methods: 1
+`
+	ok, score := shouldHostScore(t, data)
+	if ok || score.Total != 1 || score.MinScore != 2 {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_negative(t *testing.T) {
+	data := `
+authorized_useragents: [target]
+blacklist_iprange: [203.0.113.0/24]
+scoring:
+  min_score: 1
+  weights:
+    authorized_useragents: 3
+    blacklist_iprange: -5
+`
+	ok, score := shouldHostScore(t, data)
+	if ok || score.Total != -2 {
+		t.Fail()
+	}
+	for _, r := range score.Results {
+		if r.Condition == "blacklist_iprange" && (r.Passed || r.Points != -5) {
+			t.Fail()
+		}
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_unweighted_required(t *testing.T) {
+	data := `
+authorized_useragents: [target]
+authorized_methods: [POST]
+scoring:
+  weights:
+    authorized_useragents: 5
+`
+	if ok, _ := shouldHostScore(t, data); ok {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_disabled(t *testing.T) {
+	ok, score := shouldHostScore(t, "authorized_useragents: [target]")
+	if !ok || len(score.Results) != 0 {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_scoring_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("scoring:\n  weights:\n    user_agent: 1")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_scoring_not_serving(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("not_serving: true\nscoring:\n  weights:\n    not_serving: 5")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestMergeRequestConditions_scoring(t *testing.T) {
+	global, err := NewRequestConditions([]byte("scoring:\n  min_score: 2\n  weights:\n    geoip: 1\n    asn: 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact, err := NewRequestConditions([]byte("scoring:\n  weights:\n    asn: 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergeRequestConditions(global, exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Scoring.MinScore != 2 || merged.Scoring.Weights["geoip"] != 1 || merged.Scoring.Weights["asn"] != 3 {
+		t.Error(merged.Scoring)
+	}
+}
+
+func TestPaths_MatchAndServe_score(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+	serverRoot.CreatePathList(`- path: /index.html
+  hosted_file: /index.html
+  authorized_methods: [POST]
+  authorized_useragents: [target]
+  scoring:
+    min_score: 1
+    weights:
+      authorized_methods: 1
+      authorized_useragents: 1`)
+
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("User-Agent", "target")
+	served, score, err := paths.MatchAndServeScore(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Error(err)
+	}
+	if !served || score == nil || score.Total != 1 {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_unset(t *testing.T) {
+	data := `
+scoring:
+  min_score: 3
+  weights:
+    authorized_useragents: 2
+    geoip: 1
+`
+	ok, score := shouldHostScore(t, data)
+	if ok || score.Total != 0 || len(score.Results) != 0 {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHostScore_geoip_no_db(t *testing.T) {
+	data := `
+authorized_useragents: [target]
+geoip:
+  authorized_countries: [DE]
+scoring:
+  min_score: 3
+  weights:
+    authorized_useragents: 2
+    geoip: 1
+`
+	ok, score := shouldHostScore(t, data)
+	if ok || score.Total != 2 || score.String() != "authorized_useragents=+2" {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_scoring_min_score_only(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("scoring:\n  min_score: 2")); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,314 @@
+package path
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/geoip"
+	"go.starlark.net/starlark"
+)
+
+// DefaultScriptSteps is the number of Starlark steps a script may run for each request
+const DefaultScriptSteps = 100000
+
+// DefaultScriptTimeout is how long a script may run for each request
+const DefaultScriptTimeout = 100 * time.Millisecond
+
+// scriptFunction is the function a script defines to decide if a request is served
+const scriptFunction = "allow"
+
+// scriptThread creates a thread which stops after DefaultScriptSteps steps
+// or DefaultScriptTimeout. The returned function releases the timer
+func scriptThread() (*starlark.Thread, func()) {
+	thread := &starlark.Thread{
+		Name: "script",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.WithFields(log.Fields{
+				"message": msg,
+			}).Debug("Script printed")
+		},
+	}
+	thread.SetMaxExecutionSteps(DefaultScriptSteps)
+	timer := time.AfterFunc(DefaultScriptTimeout, func() {
+		thread.Cancel("timed out")
+	})
+	return thread, func() { timer.Stop() }
+}
+
+// scriptError formats Starlark errors as file:line:col: message
+func scriptError(err error) error {
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		return err
+	}
+	// Builtins have no position, so report the innermost line of the script
+	for i := range evalErr.CallStack {
+		if pos := evalErr.CallStack.At(i).Pos; pos.Line > 0 {
+			return errors.New(fmt.Sprintf("%s: %s", pos, evalErr.Msg))
+		}
+	}
+	return err
+}
+
+// loadScript compiles src and returns its allow function. line is the line of
+// filename src starts on, so errors point at the file src is written in
+func loadScript(filename string, line int, src string) (*starlark.Function, error) {
+	if line > 1 {
+		src = strings.Repeat("\n", line-1) + src
+	}
+	_, prog, err := starlark.SourceProgram(filename, src, func(string) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+
+	thread, stop := scriptThread()
+	defer stop()
+	globals, err := prog.Init(thread, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	globals.Freeze()
+
+	allow, ok := globals[scriptFunction].(*starlark.Function)
+	if !ok || allow.NumParams() != 2 {
+		return nil, errors.New(fmt.Sprintf("%s: script must define %s(request, hits)", filename, scriptFunction))
+	}
+	return allow, nil
+}
+
+// scriptLine returns the line of data where src starts, ignoring indentation,
+// or 0 when src isn't in data
+func scriptLine(data []byte, src string) int {
+	lines := strings.Split(string(data), "\n")
+	want := strings.Split(strings.TrimRight(src, "\n"), "\n")
+	for i := 0; i+len(want) <= len(lines); i++ {
+		match := true
+		for j, w := range want {
+			if strings.TrimSpace(lines[i+j]) != strings.TrimSpace(w) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// conditionScripts returns the scripts of the conditions and their nested blocks
+func conditionScripts(c RequestConditions) []string {
+	var scripts []string
+	if c.Script != "" {
+		scripts = append(scripts, c.Script)
+	}
+	for _, blocks := range [][]RequestConditions{c.AllOf, c.AnyOf, c.Not} {
+		for _, b := range blocks {
+			scripts = append(scripts, conditionScripts(b)...)
+		}
+	}
+	return scripts
+}
+
+// scriptCache holds compiled scripts by their source
+type scriptCache struct {
+	mu      sync.Mutex
+	scripts map[string]*starlark.Function
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{scripts: make(map[string]*starlark.Function)}
+}
+
+// get returns the compiled script, compiling it when it wasn't loaded on
+// Reload, such as scripts in the global conditions
+func (s *scriptCache) get(src string) (*starlark.Function, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if allow, ok := s.scripts[src]; ok {
+		return allow, nil
+	}
+	allow, err := loadScript("script", 1, src)
+	if err != nil {
+		return nil, err
+	}
+	s.scripts[src] = allow
+	return allow, nil
+}
+
+// replace swaps the compiled scripts for the ones of a new path list
+func (s *scriptCache) replace(scripts map[string]*starlark.Function) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = scripts
+}
+
+// loadScripts compiles the scripts of the path list, reporting errors with
+// the line of the path list file they are on
+func (paths *Paths) loadScripts(pathList []*Path, data []byte) (map[string]*starlark.Function, error) {
+	scripts := make(map[string]*starlark.Function)
+	for _, v := range pathList {
+		for _, src := range conditionScripts(v.Conditions) {
+			if _, ok := scripts[src]; ok {
+				continue
+			}
+			filename, line := paths.pathsList, scriptLine(data, src)
+			if line == 0 {
+				filename = "script"
+			}
+			allow, err := loadScript(filename, line, src)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid script: "+v.Path)
+			}
+			scripts[src] = allow
+		}
+	}
+	return scripts, nil
+}
+
+// toStarlark converts a decoded JSON value to a frozen Starlark value
+func toStarlark(v interface{}) (starlark.Value, error) {
+	var value starlark.Value
+	switch v := v.(type) {
+	case nil:
+		value = starlark.None
+	case bool:
+		value = starlark.Bool(v)
+	case string:
+		value = starlark.String(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			value = starlark.MakeInt64(i)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return nil, err
+			}
+			value = starlark.Float(f)
+		}
+	case []interface{}:
+		list := make([]starlark.Value, 0, len(v))
+		for _, e := range v {
+			item, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		value = starlark.NewList(list)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(v))
+		for _, k := range keys {
+			item, err := toStarlark(v[k])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(k), item); err != nil {
+				return nil, err
+			}
+		}
+		value = dict
+	default:
+		return nil, errors.New(fmt.Sprintf("unable to convert %T", v))
+	}
+	value.Freeze()
+	return value, nil
+}
+
+// scriptArgs converts the exec document to the request and hits given to scripts
+func scriptArgs(doc ExecRequest) (starlark.Value, starlark.Value, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, nil, err
+	}
+
+	hits, err := toStarlark(fields["hits"])
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(fields, "hits")
+	request, err := toStarlark(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, hits, nil
+}
+
+func (c *RequestConditions) scriptMatch(req *http.Request, state *State, gip geoip.DB) bool {
+	if c.Script == "" {
+		log.Trace("No script")
+		return true
+	}
+
+	var allow *starlark.Function
+	var err error
+	if state != nil {
+		allow, err = state.scripts.get(c.Script)
+	} else {
+		allow, err = loadScript("script", 1, c.Script)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Invalid script")
+		return false
+	}
+
+	doc, err := c.newExecRequest(req, state, gip)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Unable to build script request")
+		return false
+	}
+	request, hits, err := scriptArgs(doc)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Unable to build script request")
+		return false
+	}
+
+	thread, stop := scriptThread()
+	defer stop()
+	v, err := starlark.Call(thread, allow, starlark.Tuple{request, hits}, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": scriptError(err),
+		}).Debug("Script failed")
+		return false
+	}
+
+	allowed, ok := v.(starlark.Bool)
+	if !ok {
+		log.WithFields(log.Fields{
+			"type": v.Type(),
+		}).Debug("Script did not return a bool")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"allow": bool(allowed),
+		"steps": thread.ExecutionSteps(),
+	}).Debug("Script verdict")
+	return bool(allowed)
+}
@@ -0,0 +1,133 @@
+package path_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+func shouldHostScript(t *testing.T, data string) bool {
+	mockRequest := httptest.NewRequest("GET", "/index.html", nil)
+	mockRequest.RemoteAddr = "198.51.100.1:1234"
+	mockRequest.Header.Set("User-Agent", "target")
+
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conditions.ShouldHost(mockRequest, state, geoip.DB{})
+}
+
+func TestRequestConditions_ShouldHost_script_allow(t *testing.T) {
+	data := `
+script: |
+  def allow(request, hits):
+      return request["headers"]["User-Agent"][0] == "target"
+`
+	if !shouldHostScript(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_script_deny(t *testing.T) {
+	data := `
+script: |
+  def allow(request, hits):
+      return request["method"] == "POST"
+`
+	if shouldHostScript(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_script_hits(t *testing.T) {
+	data := `
+script: |
+  def allow(request, hits):
+      return hits["path"] == 0 and hits["history"] == []
+`
+	if !shouldHostScript(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_script_not_bool(t *testing.T) {
+	data := `
+script: |
+  def allow(request, hits):
+      return "yes"
+`
+	if shouldHostScript(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_script_error(t *testing.T) {
+	data := `
+script: |
+  def allow(request, hits):
+      return request["missing"]
+`
+	if shouldHostScript(t, data) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_script_steps(t *testing.T) {
+	data := `
+script: |
+  def allow(request, hits):
+      for i in range(100000000):
+          pass
+      return True
+`
+	start := time.Now()
+	if shouldHostScript(t, data) {
+		t.Fail()
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("script was not stopped")
+	}
+}
+
+func TestNewRequestConditions_script_syntax(t *testing.T) {
+	_, err := NewRequestConditions([]byte("script: |\n  def allow(request, hits):\n      return (\n"))
+	if err == nil || !strings.Contains(err.Error(), "script:3:") {
+		t.Error(err)
+	}
+}
+
+func TestNewRequestConditions_script_no_allow(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("script: |\n  x = 1\n")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestNewDefault_script_line(t *testing.T) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	defer serverRoot.Close()
+	serverRoot.CreateIndexFile()
+	serverRoot.CreatePathListIndex(
+		"script: |",
+		"  def allow(request, hits):",
+		"      return undefined_name",
+	)
+
+	_, err = NewDefaultTest(serverRoot.Path)
+	if err == nil || !strings.Contains(err.Error(), "pathList.yml:5:") {
+		t.Error(err)
+	}
+}
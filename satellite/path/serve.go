@@ -0,0 +1,140 @@
+package path
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// DefaultSessionCookie is the cookie used by serve_per_session when session_cookie is not set
+const DefaultSessionCookie = "session"
+
+// ja3Key is the JA3N hash the per-JA3 serve counters are keyed on. Clients
+// such as Chrome shuffle their extensions, so the plain JA3 hash changes on
+// every connection
+func ja3Key(ja3 string) string {
+	hash := md5.Sum([]byte(NormalizeJA3(ja3)))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *RequestConditions) sessionCookie() string {
+	if c.SessionCookie != "" {
+		return c.SessionCookie
+	}
+	return DefaultSessionCookie
+}
+
+// session returns the session cookie of the request
+func (c *RequestConditions) session(req *http.Request) string {
+	cookie, err := req.Cookie(c.sessionCookie())
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// hit records that the file was served to the client of req
+func (c *RequestConditions) hit(req *http.Request, state *State) error {
+	if err := state.Hit(req); err != nil {
+		return err
+	}
+
+	// Per-client counters are only kept for paths limiting them, so the DB
+	// doesn't grow with every client
+	if c.ServePerIP != 0 {
+		if ip := util.GetHost(req); ip != nil {
+			if err := state.HitBy(req.URL.Path, ServeIP, ip.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.ServePerJA3 != 0 && req.JA3Fingerprint != "" {
+		if err := state.HitBy(req.URL.Path, ServeJA3, ja3Key(req.JA3Fingerprint)); err != nil {
+			return err
+		}
+	}
+
+	if c.ServePerSession != 0 {
+		if session := c.session(req); session != "" {
+			return state.HitBy(req.URL.Path, ServeSession, session)
+		}
+	}
+
+	return nil
+}
+
+// clientServeLimit checks the times_served of path for one client against limit
+func clientServeLimit(state *State, path, kind, id string, limit uint64) bool {
+	if limit == 0 {
+		return true
+	}
+	if id == "" {
+		log.WithFields(log.Fields{
+			"serve_limit": limit,
+			"client":      kind,
+		}).Debug("No client identifier for serve limit")
+		return false
+	}
+
+	hits, err := state.GetHitsBy(path, kind, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client": kind,
+			"error":  err,
+		}).Debug("Error getting times served")
+		return false
+	}
+	if hits >= limit {
+		log.WithFields(log.Fields{
+			"serve_limit":  limit,
+			"times_served": hits,
+			"client":       kind,
+			kind:           id,
+		}).Debug("Client exceeds times served")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"serve_limit":  limit,
+		"times_served": hits,
+		"client":       kind,
+	}).Trace("Client served")
+	return true
+}
+
+func (c *RequestConditions) clientServeLimits(req *http.Request, state *State) bool {
+	if req.URL == nil {
+		return true
+	}
+	path := req.URL.Path
+
+	if c.ServePerIP != 0 {
+		ip := ""
+		if host := util.GetHost(req); host != nil {
+			ip = host.String()
+		}
+		if !clientServeLimit(state, path, ServeIP, ip, c.ServePerIP) {
+			return false
+		}
+	}
+
+	if !clientServeLimit(state, path, ServeSession, c.session(req), c.ServePerSession) {
+		return false
+	}
+
+	if c.ServePerJA3 != 0 {
+		ja3 := ""
+		if req.JA3Fingerprint != "" {
+			ja3 = ja3Key(req.JA3Fingerprint)
+		}
+		if !clientServeLimit(state, path, ServeJA3, ja3, c.ServePerJA3) {
+			return false
+		}
+	}
+
+	return true
+}
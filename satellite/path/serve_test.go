@@ -0,0 +1,181 @@
+package path_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+func serveRequest(remoteAddr, session, ja3 string) *http.Request {
+	req := httptest.NewRequest("GET", "/payload", nil)
+	req.RemoteAddr = remoteAddr
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	req.JA3Fingerprint = ja3
+	return req
+}
+
+// serveTwice serves first and then checks if second should be served
+func serveTwice(t *testing.T, data string, first, second *http.Request) bool {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	p, err := NewPathData([]byte("path: /payload\n" + data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !p.ShouldHost(first, state, geoip.DB{}) {
+		t.Error("first request was not served")
+	}
+	return p.ShouldHost(second, state, geoip.DB{})
+}
+
+func TestRequestConditions_ShouldHost_serve_per_ip_other(t *testing.T) {
+	first := serveRequest("198.51.100.1:1234", "", "")
+	second := serveRequest("198.51.100.2:1234", "", "")
+	if !serveTwice(t, "serve_per_ip: 1", first, second) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_ip_same(t *testing.T) {
+	first := serveRequest("198.51.100.1:1234", "", "")
+	second := serveRequest("198.51.100.1:4321", "", "")
+	if serveTwice(t, "serve_per_ip: 1", first, second) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_session_other(t *testing.T) {
+	first := serveRequest("198.51.100.1:1234", "a", "")
+	second := serveRequest("198.51.100.1:1234", "b", "")
+	if !serveTwice(t, "serve_per_session: 1", first, second) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_session_same(t *testing.T) {
+	first := serveRequest("198.51.100.1:1234", "a", "")
+	second := serveRequest("198.51.100.2:1234", "a", "")
+	if serveTwice(t, "serve_per_session: 1", first, second) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_session_cookie(t *testing.T) {
+	first := serveRequest("198.51.100.1:1234", "", "")
+	first.AddCookie(&http.Cookie{Name: "sid", Value: "a"})
+	second := serveRequest("198.51.100.1:1234", "", "")
+	second.AddCookie(&http.Cookie{Name: "sid", Value: "a"})
+	if serveTwice(t, "serve_per_session: 1\nsession_cookie: sid", first, second) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_session_none(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte("serve_per_session: 1"))
+	if err != nil {
+		t.Error(err)
+	}
+	if conditions.ShouldHost(serveRequest("198.51.100.1:1234", "", ""), state, geoip.DB{}) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_ja3_same(t *testing.T) {
+	// The second ClientHello shuffles its extensions
+	first := serveRequest("198.51.100.1:1234", "", "771,4865-4866,0-23-65281-10,29-23,0")
+	second := serveRequest("198.51.100.2:1234", "", "771,4865-4866,65281-10-0-23,29-23,0")
+	if serveTwice(t, "serve_per_ja3: 1", first, second) {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_serve_per_ja3_other(t *testing.T) {
+	first := serveRequest("198.51.100.1:1234", "", "771,4865-4866,0-23-65281-10,29-23,0")
+	second := serveRequest("198.51.100.1:1234", "", "771,49195-49199,0-23-65281-10,29-23,0")
+	if !serveTwice(t, "serve_per_ja3: 1", first, second) {
+		t.Fail()
+	}
+}
+
+func TestState_GetHitsBy(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer RemoveDB(file)
+
+	for i := 0; i < 2; i++ {
+		if err := state.HitBy("/payload", ServeIP, "198.51.100.1"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if hits, err := state.GetHitsBy("/payload", ServeIP, "198.51.100.1"); err != nil || hits != 2 {
+		t.Errorf("%d hits: %v", hits, err)
+	}
+	if hits, err := state.GetHitsBy("/payload", ServeIP, "198.51.100.2"); err != nil || hits != 0 {
+		t.Errorf("%d hits: %v", hits, err)
+	}
+}
+
+// clientHits serves req with the path options and returns the per-IP and per-JA3 counters
+func clientHits(t *testing.T, data string, req *http.Request) (uint64, uint64) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer RemoveDB(file)
+
+	p, err := NewPathData([]byte("path: /payload\n" + data))
+	if err != nil {
+		t.Error(err)
+	}
+	if !p.ShouldHost(req, state, geoip.DB{}) {
+		t.Error("request was not served")
+	}
+
+	ipHits, err := state.GetHitsBy("/payload", ServeIP, "198.51.100.1")
+	if err != nil {
+		t.Error(err)
+	}
+	ja3Hash := md5.Sum([]byte(NormalizeJA3(req.JA3Fingerprint)))
+	ja3Hits, err := state.GetHitsBy("/payload", ServeJA3, hex.EncodeToString(ja3Hash[:]))
+	if err != nil {
+		t.Error(err)
+	}
+	return ipHits, ja3Hits
+}
+
+func TestPath_ShouldHost_client_hits(t *testing.T) {
+	req := serveRequest("198.51.100.1:1234", "", "771,4865-4866,0-23-65281,29-23,0")
+	if ip, ja3 := clientHits(t, "serve_per_ip: 5\nserve_per_ja3: 5", req); ip != 1 || ja3 != 1 {
+		t.Errorf("%d ip hits, %d ja3 hits", ip, ja3)
+	}
+}
+
+func TestPath_ShouldHost_client_hits_unlimited(t *testing.T) {
+	// Without per-client limits, no per-client keys are written
+	req := serveRequest("198.51.100.1:1234", "", "771,4865-4866,0-23-65281,29-23,0")
+	if ip, ja3 := clientHits(t, "", req); ip != 0 || ja3 != 0 {
+		t.Errorf("%d ip hits, %d ja3 hits", ip, ja3)
+	}
+}
@@ -0,0 +1,171 @@
+package path
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// Errors returned when a signed URL token is not accepted
+var (
+	ErrNoSigningKey = errors.New("no signed_url key is configured")
+	ErrBadToken     = errors.New("signed URL token is invalid")
+	ErrTokenExpired = errors.New("signed URL token expired")
+	ErrTokenIP      = errors.New("signed URL token is bound to another IP")
+	ErrTokenUsed    = errors.New("signed URL token has no uses left")
+)
+
+// SignedToken is the content of a signed URL token
+type SignedToken struct {
+	// File is the hosted file served for the token
+	File string `json:"f"`
+	// Expires is the Unix time the token expires at
+	Expires int64 `json:"e"`
+	// IP is the only client IP which can use the token, when set
+	IP string `json:"ip,omitempty"`
+	// Uses is how many times the token can be used, unlimited when zero
+	Uses uint64 `json:"n,omitempty"`
+	// ID makes every token unique and keys its use count
+	ID string `json:"id"`
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+func tokenSignature(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// MintToken creates a token for file which expires after ttl. It is bound to
+// ip when ip is not nil, and can be used uses times, or unlimited times when
+// uses is zero
+func MintToken(key []byte, file string, ttl time.Duration, ip net.IP, uses uint64) (string, error) {
+	if len(key) == 0 {
+		return "", ErrNoSigningKey
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	token := SignedToken{
+		File:    path.Clean("/" + file),
+		Expires: now().Add(ttl).Unix(),
+		Uses:    uses,
+		ID:      hex.EncodeToString(id),
+	}
+	if ip != nil {
+		token.IP = clientKey(ip)
+	}
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return tokenEncoding.EncodeToString(payload) + "." + tokenEncoding.EncodeToString(tokenSignature(key, payload)), nil
+}
+
+// ParseToken checks the signature and expiry of a token
+func ParseToken(key []byte, s string) (SignedToken, error) {
+	var token SignedToken
+	if len(key) == 0 {
+		return token, ErrNoSigningKey
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return token, ErrBadToken
+	}
+	payload, err := tokenEncoding.DecodeString(parts[0])
+	if err != nil {
+		return token, ErrBadToken
+	}
+	signature, err := tokenEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, tokenSignature(key, payload)) {
+		return token, ErrBadToken
+	}
+	if err := json.Unmarshal(payload, &token); err != nil || token.File == "" || token.ID == "" {
+		return token, ErrBadToken
+	}
+
+	if now().Unix() >= token.Expires {
+		return token, ErrTokenExpired
+	}
+	return token, nil
+}
+
+// AddSigningKey sets the key signed_url tokens are signed with
+func (paths *Paths) AddSigningKey(key string) {
+	paths.signingKey = []byte(key)
+}
+
+// signedPath returns the path served for the token at the end of the URI,
+// when matchedPath is a signed_url path, and the token
+func (paths *Paths) signedPath(req *http.Request, matchedPath *Path) (*Path, *SignedToken, error) {
+	if !matchedPath.SignedURL {
+		return matchedPath, nil, nil
+	}
+
+	token, err := ParseToken(paths.signingKey, path.Base(req.URL.Path))
+	if err != nil {
+		return nil, nil, err
+	}
+	if token.IP != "" && token.IP != clientKey(util.GetHost(req)) {
+		return nil, nil, ErrTokenIP
+	}
+
+	served := *matchedPath
+	served.HostedFile = token.File
+	return &served, &token, nil
+}
+
+// UseToken counts a use of a token. It fails when the token has no uses left
+func (s *State) UseToken(token SignedToken) error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	key := serveKey("", "token", token.ID)
+	if token.Uses != 0 {
+		used, err := s.GetHits(key)
+		if err != nil {
+			return err
+		}
+		if used >= token.Uses {
+			return ErrTokenUsed
+		}
+	}
+	return s.hit(key)
+}
+
+// useSignedToken consumes a use of the token, when there is one
+func (paths *Paths) useSignedToken(token *SignedToken) bool {
+	if token == nil {
+		return true
+	}
+	if err := paths.state.UseToken(*token); err != nil {
+		log.WithFields(log.Fields{
+			"token_id": token.ID,
+			"file":     token.File,
+			"error":    err,
+		}).Debug("Signed URL rejected")
+		return false
+	}
+	log.WithFields(log.Fields{
+		"token_id": token.ID,
+		"file":     token.File,
+	}).Debug("Signed URL used")
+	return true
+}
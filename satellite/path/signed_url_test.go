@@ -0,0 +1,151 @@
+package path_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http/httptest"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+var signingKey = []byte("test signing key")
+
+func TestParseToken(t *testing.T) {
+	s, err := MintToken(signingKey, "payload.exe", time.Hour, net.ParseIP("198.51.100.1"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ParseToken(signingKey, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.File != "/payload.exe" || token.IP != "198.51.100.1" || token.Uses != 2 || token.ID == "" {
+		t.Errorf("unexpected token %+v", token)
+	}
+}
+
+func TestParseToken_tampered(t *testing.T) {
+	s, err := MintToken(signingKey, "/payload.exe", time.Hour, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := MintToken(signingKey, "/other.exe", time.Hour, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload of one token with the signature of another
+	forged := strings.Split(other, ".")[0] + "." + strings.Split(s, ".")[1]
+	for _, bad := range []string{forged, "", "abc", s + "x"} {
+		if _, err := ParseToken(signingKey, bad); err != ErrBadToken {
+			t.Errorf("%q: %v", bad, err)
+		}
+	}
+	if _, err := ParseToken([]byte("other key"), s); err != ErrBadToken {
+		t.Error(err)
+	}
+}
+
+func TestParseToken_expired(t *testing.T) {
+	s, err := MintToken(signingKey, "/payload.exe", -time.Minute, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseToken(signingKey, s); err != ErrTokenExpired {
+		t.Error(err)
+	}
+}
+
+func TestMintToken_nokey(t *testing.T) {
+	if _, err := MintToken(nil, "/payload.exe", time.Hour, nil, 1); err != ErrNoSigningKey {
+		t.Error(err)
+	}
+}
+
+// signedPaths serves /payload.exe through the signed_url path /d/*
+func signedPaths(t *testing.T) (*Paths, func()) {
+	serverRoot, err := NewTempDir()
+	if err != nil {
+		t.Error(err)
+	}
+	serverRoot.CreateIndexFile()
+	serverRoot.CreateFile("payload.exe", "payload")
+	serverRoot.CreatePathList(`- path: /d/*
+  signed_url: true`)
+
+	paths, err := NewDefaultTest(serverRoot.Path)
+	if err != nil {
+		t.Error(err)
+	}
+	paths.AddSigningKey(string(signingKey))
+	return paths, func() { serverRoot.Close() }
+}
+
+func signedRequest(t *testing.T, paths *Paths, token, remoteAddr string) (bool, string) {
+	req := httptest.NewRequest("GET", "/d/"+token, nil)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	served, err := paths.MatchAndServe(w, req)
+	if err != nil {
+		t.Error(err)
+	}
+	return served, w.Body.String()
+}
+
+func TestPaths_MatchAndServe_signed_url_once(t *testing.T) {
+	paths, closer := signedPaths(t)
+	defer closer()
+
+	token, err := MintToken(signingKey, "/payload.exe", time.Hour, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served, body := signedRequest(t, paths, token, "198.51.100.1:1"); !served || body != "payload" {
+		t.Errorf("token was not served: %q", body)
+	}
+	if served, _ := signedRequest(t, paths, token, "198.51.100.1:1"); served {
+		t.Error("used token was served")
+	}
+}
+
+func TestPaths_MatchAndServe_signed_url_unlimited(t *testing.T) {
+	paths, closer := signedPaths(t)
+	defer closer()
+
+	token, err := MintToken(signingKey, "/payload.exe", time.Hour, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if served, _ := signedRequest(t, paths, token, "198.51.100.1:1"); !served {
+			t.Errorf("use %d was not served", i)
+		}
+	}
+}
+
+func TestPaths_MatchAndServe_signed_url_ip(t *testing.T) {
+	paths, closer := signedPaths(t)
+	defer closer()
+
+	token, err := MintToken(signingKey, "/payload.exe", time.Hour, net.ParseIP("198.51.100.1"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served, _ := signedRequest(t, paths, token, "198.51.100.2:1"); served {
+		t.Error("token was served to another IP")
+	}
+	if served, _ := signedRequest(t, paths, token, "198.51.100.1:1"); !served {
+		t.Error("token was not served to its IP")
+	}
+}
+
+func TestPaths_MatchAndServe_signed_url_bad(t *testing.T) {
+	paths, closer := signedPaths(t)
+	defer closer()
+
+	if served, _ := signedRequest(t, paths, "not-a-token", "198.51.100.1:1"); served {
+		t.Fail()
+	}
+}
@@ -2,15 +2,18 @@ package path
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/binary"
 	"net"
-	"strings"
+	"sync"
+	"time"
 
 	// Used for gosql
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/prologic/bitcask"
 	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/util"
 )
 
 // State contains all state for Paths configuration
@@ -18,11 +21,36 @@ type State struct {
 	db *bitcask.Bitcask
 	// PathIdentifier is the global ClientID
 	pathIdentifier *ClientID
+	// tokenMu makes checking and counting signed URL uses atomic
+	tokenMu sync.Mutex
+	// limiter is shared by the rate limits of every path
+	limiter *RateLimiter
+	// execVerdicts caches the verdicts of exec conditions
+	execVerdicts *verdictCache
+	// webhookVerdicts caches the verdicts of webhook conditions
+	webhookVerdicts *verdictCache
+	// webhookClient is the client used by webhook conditions
+	webhookClient *http.Client
+	// rdns resolves the hostnames of reverse DNS conditions
+	rdns *RDNSResolver
+	// scripts are the compiled script conditions
+	scripts *scriptCache
+	// clientCAs verify the client certificates of paths without a CA of their own
+	clientCAs *x509.CertPool
 }
 
 // NewState creates the prereqs for managing state in Satellite
 func NewState(dbPath string) (*State, error) {
-	state := &State{db: nil, pathIdentifier: NewClientID()}
+	state := &State{
+		db:              nil,
+		pathIdentifier:  NewClientID(),
+		limiter:         NewRateLimiter(),
+		execVerdicts:    newVerdictCache(),
+		webhookVerdicts: newVerdictCache(),
+		webhookClient:   &http.Client{},
+		rdns:            NewRDNSResolver("", 2*time.Second, 10*time.Minute),
+		scripts:         newScriptCache(),
+	}
 
 	database, err := bitcask.Open(dbPath)
 	if err != nil {
@@ -33,6 +61,17 @@ func NewState(dbPath string) (*State, error) {
 	return state, nil
 }
 
+// SetWebhookClient sets the client used by webhook conditions, such as one
+// trusting a private CA
+func (s *State) SetWebhookClient(client *http.Client) {
+	s.webhookClient = client
+}
+
+// SetRDNS sets the resolver used by reverse DNS conditions
+func (s *State) SetRDNS(r *RDNSResolver) {
+	s.rdns = r
+}
+
 // exists checks if a path exists in the db
 func (s *State) exists(path string) bool {
 	return s.db.Has([]byte(path))
@@ -65,7 +104,29 @@ func (s *State) incrementServed(path string) error {
 // ErrNoURL is returned when a request has no URL in the request
 var ErrNoURL = errors.New("No URL for request")
 
-// Hit will create a path in the DB if it does not exist, and increment the times_served if it does exist
+// Keys of the per-client serve counters
+const (
+	ServeIP      = "ip"
+	ServeSession = "session"
+	ServeJA3     = "ja3"
+)
+
+// serveKey is the DB key of the times_served of path for one client
+func serveKey(path, kind, id string) string {
+	return path + "\x00" + kind + "\x00" + id
+}
+
+// hit creates a key in the DB if it does not exist, and increments it if it does exist
+func (s *State) hit(key string) error {
+	if exists := s.exists(key); !exists {
+		return s.create(key)
+	}
+
+	return s.incrementServed(key)
+}
+
+// Hit will create a path in the DB if it does not exist, and increment the
+// times_served if it does exist
 func (s *State) Hit(req *http.Request) error {
 	if req.URL == nil {
 		return ErrNoURL
@@ -73,16 +134,16 @@ func (s *State) Hit(req *http.Request) error {
 	path := req.URL.Path
 
 	// ClientID Hit
-	ip := strings.Split(req.RemoteAddr, ":")[0]
-	remoteAddr := net.ParseIP(ip)
-	s.pathIdentifier.Hit(remoteAddr, path)
+	s.pathIdentifier.Hit(util.GetHost(req), path)
 
 	// DB Hit
-	if exists := s.exists(path); !exists {
-		return s.create(path)
-	}
+	return s.hit(path)
+}
 
-	return s.incrementServed(path)
+// HitBy increments the times_served of path for the client identified by id,
+// such as ServeSession and a session cookie
+func (s *State) HitBy(path, kind, id string) error {
+	return s.hit(serveKey(path, kind, id))
 }
 
 // GetHits gets the number of hits for a target path using the SQLite DB
@@ -103,11 +164,21 @@ func (s *State) GetHits(path string) (uint64, error) {
 	return timesRead, nil
 }
 
+// GetHitsBy gets the number of hits for a target path by the client identified by id
+func (s *State) GetHitsBy(path, kind, id string) (uint64, error) {
+	return s.GetHits(serveKey(path, kind, id))
+}
+
 // MatchPaths checks if an IP has hit the specified paths in order to make sure an IP can access a page
 func (s *State) MatchPaths(ip net.IP, paths []string) bool {
 	return s.pathIdentifier.Match(ip, paths)
 }
 
+// History returns the paths served to an IP, oldest first
+func (s *State) History(ip net.IP) []string {
+	return s.pathIdentifier.History(ip)
+}
+
 // Remove removes path from DB
 func (s *State) Remove(path string) error {
 	return s.db.Delete([]byte(path))
@@ -2,6 +2,7 @@ package path_test
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"testing"
 
@@ -67,6 +68,31 @@ func TestState_Hit(t *testing.T) {
 	}
 }
 
+func TestState_Hit_ipv6(t *testing.T) {
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	req.RemoteAddr = "[2001:db8::1]:54321"
+
+	if err := state.Hit(req); err != nil {
+		t.Error(err)
+	}
+	if !state.MatchPaths(net.ParseIP("2001:db8::1"), []string{"/"}) {
+		t.Fail()
+	}
+
+	if err := RemoveDB(file); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestState_gethits_none(t *testing.T) {
 	state, file, err := TemporaryDB()
 	if err != nil {
@@ -0,0 +1,210 @@
+package path
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/crypto/tls"
+	"github.com/t94j0/satellite/net/http"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as 1.2
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("%s is not a valid TLS version", version))
+	}
+	return v, nil
+}
+
+// parseCipherSuite parses a cipher suite name such as TLS_AES_128_GCM_SHA256
+func parseCipherSuite(name string) (uint16, error) {
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, suite := range suites {
+		if strings.EqualFold(suite.Name, name) {
+			return suite.ID, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("%s is not a valid cipher suite", name))
+}
+
+// matchCipherSuite returns the cipher suite in names which is id
+func matchCipherSuite(names []string, id uint16) (string, bool) {
+	for _, name := range names {
+		if suite, err := parseCipherSuite(name); err == nil && suite == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// requestHost returns the Host of the request without the port
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+}
+
+func (c *RequestConditions) authorizedSNI(req *http.Request) bool {
+	if len(c.AuthorizedSNI) == 0 {
+		log.Trace("No authorized SNI")
+		return true
+	}
+	if req.TLS == nil {
+		log.Debug("No TLS connection for authorized SNI")
+		return false
+	}
+
+	sni := strings.ToLower(req.TLS.ServerName)
+	for _, s := range c.AuthorizedSNI {
+		g := glob.MustCompile(strings.ToLower(s))
+		if g.Match(sni) {
+			log.WithFields(log.Fields{
+				"target_sni": s,
+				"sni":        sni,
+			}).Debug("Matched authorized SNI")
+			return true
+		}
+		log.WithFields(log.Fields{
+			"target_sni": s,
+			"sni":        sni,
+		}).Trace("Did not match authorized SNI")
+	}
+
+	return false
+}
+
+func (c *RequestConditions) minTLSVersion(req *http.Request) bool {
+	if c.MinTLSVersion == "" {
+		log.Trace("No minimum TLS version")
+		return true
+	}
+	if req.TLS == nil {
+		log.Debug("No TLS connection for min_tls_version")
+		return false
+	}
+
+	min, err := parseTLSVersion(c.MinTLSVersion)
+	if err != nil || req.TLS.Version < min {
+		log.WithFields(log.Fields{
+			"min_tls_version": c.MinTLSVersion,
+			"tls_version":     fmt.Sprintf("%#04x", req.TLS.Version),
+		}).Debug("TLS version is below min_tls_version")
+		return false
+	}
+
+	return true
+}
+
+func (c *RequestConditions) requiredALPN(req *http.Request) bool {
+	if len(c.RequiredALPN) == 0 {
+		log.Trace("No required ALPN")
+		return true
+	}
+	if req.TLS == nil || req.TLS.ClientHello == nil {
+		log.Debug("No ClientHello for required_alpn")
+		return false
+	}
+
+	offered := req.TLS.ClientHello.SupportedProtos
+	for _, proto := range c.RequiredALPN {
+		found := false
+		for _, o := range offered {
+			if o == proto {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.WithFields(log.Fields{
+				"required_alpn": proto,
+				"alpn":          offered,
+			}).Debug("Client did not offer required ALPN protocol")
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *RequestConditions) authorizedCiphers(req *http.Request) bool {
+	if len(c.AuthorizedCiphers) == 0 {
+		log.Trace("No authorized ciphers")
+		return true
+	}
+	if req.TLS == nil {
+		log.Debug("No TLS connection for authorized_ciphers")
+		return false
+	}
+
+	cipher := tls.CipherSuiteName(req.TLS.CipherSuite)
+	if name, ok := matchCipherSuite(c.AuthorizedCiphers, req.TLS.CipherSuite); ok {
+		log.WithFields(log.Fields{
+			"target_cipher": name,
+			"cipher":        cipher,
+		}).Debug("Matched authorized cipher")
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"cipher": cipher,
+	}).Debug("Did not match authorized cipher")
+	return false
+}
+
+func (c *RequestConditions) blacklistCiphers(req *http.Request) bool {
+	if len(c.BlacklistCiphers) == 0 {
+		log.Trace("No blacklisted ciphers")
+		return true
+	}
+	if req.TLS == nil {
+		log.Trace("No TLS connection for blacklist_ciphers")
+		return true
+	}
+
+	cipher := tls.CipherSuiteName(req.TLS.CipherSuite)
+	if name, ok := matchCipherSuite(c.BlacklistCiphers, req.TLS.CipherSuite); ok {
+		log.WithFields(log.Fields{
+			"target_cipher": name,
+			"cipher":        cipher,
+		}).Debug("Matched blacklisted cipher")
+		return false
+	}
+
+	return true
+}
+
+func (c *RequestConditions) sniMatch(req *http.Request) bool {
+	if !c.RequireSNIMatch {
+		return true
+	}
+	if req.TLS == nil {
+		log.Debug("No TLS connection for require_sni_match")
+		return false
+	}
+
+	sni := req.TLS.ServerName
+	host := requestHost(req)
+	if sni == "" || !strings.EqualFold(sni, host) {
+		log.WithFields(log.Fields{
+			"sni":  sni,
+			"host": host,
+		}).Debug("SNI does not match Host")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,161 @@
+package path_test
+
+import (
+	"testing"
+
+	"github.com/t94j0/satellite/crypto/tls"
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+func shouldHostTLS(t *testing.T, host string, state *tls.ConnectionState, data string) bool {
+	mockRequest := httptest.NewRequest("GET", "/", nil)
+	mockRequest.Host = host
+	mockRequest.TLS = state
+
+	db, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+
+	conditions, err := NewRequestConditions([]byte(data))
+	if err != nil {
+		t.Error(err)
+	}
+	return conditions.ShouldHost(mockRequest, db, geoip.DB{})
+}
+
+func cipherState(cipher uint16) *tls.ConnectionState {
+	state := tlsState("example.com", tls.VersionTLS13)
+	state.CipherSuite = cipher
+	return state
+}
+
+func tlsState(sni string, version uint16, alpn ...string) *tls.ConnectionState {
+	return &tls.ConnectionState{
+		ServerName: sni,
+		Version:    version,
+		ClientHello: &tls.ClientHelloInfo{
+			ServerName:        sni,
+			SupportedVersions: []uint16{version},
+			SupportedProtos:   alpn,
+		},
+	}
+}
+
+func TestRequestConditions_ShouldHost_sni_succeed(t *testing.T) {
+	state := tlsState("cdn.example.com", tls.VersionTLS13)
+	if !shouldHostTLS(t, "cdn.example.com", state, "authorized_sni: ['*.example.com']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_sni_fail(t *testing.T) {
+	state := tlsState("other.test", tls.VersionTLS13)
+	if shouldHostTLS(t, "other.test", state, "authorized_sni: ['*.example.com']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_sni_plaintext(t *testing.T) {
+	if shouldHostTLS(t, "cdn.example.com", nil, "authorized_sni: ['*.example.com']") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_min_tls_version_succeed(t *testing.T) {
+	state := tlsState("example.com", tls.VersionTLS13)
+	if !shouldHostTLS(t, "example.com", state, "min_tls_version: '1.2'") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_min_tls_version_fail(t *testing.T) {
+	state := tlsState("example.com", tls.VersionTLS11)
+	if shouldHostTLS(t, "example.com", state, "min_tls_version: '1.2'") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_min_tls_version_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("min_tls_version: '2.0'")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_required_alpn_succeed(t *testing.T) {
+	state := tlsState("example.com", tls.VersionTLS13, "h2", "http/1.1")
+	if !shouldHostTLS(t, "example.com", state, "required_alpn: [h2, http/1.1]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_required_alpn_fail(t *testing.T) {
+	state := tlsState("example.com", tls.VersionTLS13, "http/1.1")
+	if shouldHostTLS(t, "example.com", state, "required_alpn: [h2]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_authorized_ciphers_succeed(t *testing.T) {
+	state := cipherState(tls.TLS_AES_128_GCM_SHA256)
+	if !shouldHostTLS(t, "example.com", state, "authorized_ciphers: [tls_aes_128_gcm_sha256]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_authorized_ciphers_fail(t *testing.T) {
+	state := cipherState(tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA)
+	if shouldHostTLS(t, "example.com", state, "authorized_ciphers: [TLS_AES_128_GCM_SHA256]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_authorized_ciphers_plaintext(t *testing.T) {
+	if shouldHostTLS(t, "example.com", nil, "authorized_ciphers: [TLS_AES_128_GCM_SHA256]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_blacklist_ciphers(t *testing.T) {
+	state := cipherState(tls.TLS_RSA_WITH_RC4_128_SHA)
+	if shouldHostTLS(t, "example.com", state, "blacklist_ciphers: [TLS_RSA_WITH_RC4_128_SHA]") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_blacklist_ciphers_none(t *testing.T) {
+	state := cipherState(tls.TLS_AES_128_GCM_SHA256)
+	if !shouldHostTLS(t, "example.com", state, "blacklist_ciphers: [TLS_RSA_WITH_RC4_128_SHA]") {
+		t.Fail()
+	}
+}
+
+func TestNewRequestConditions_ciphers_bad(t *testing.T) {
+	if _, err := NewRequestConditions([]byte("blacklist_ciphers: [TLS_NOT_A_CIPHER]")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_sni_match_succeed(t *testing.T) {
+	state := tlsState("Example.com", tls.VersionTLS13)
+	if !shouldHostTLS(t, "example.com:443", state, "require_sni_match: true") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_sni_match_fronted(t *testing.T) {
+	state := tlsState("allowed.cdn.test", tls.VersionTLS13)
+	if shouldHostTLS(t, "hidden.example.com", state, "require_sni_match: true") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_sni_match_empty(t *testing.T) {
+	state := tlsState("", tls.VersionTLS13)
+	if shouldHostTLS(t, "203.0.113.7", state, "require_sni_match: true") {
+		t.Fail()
+	}
+}
@@ -0,0 +1,248 @@
+package path
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/satellite/geoip"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// DefaultWebhookTimeout is how long a webhook may take when webhook.timeout is not set
+const DefaultWebhookTimeout = 2 * time.Second
+
+// WebhookSignatureHeader carries the HMAC-SHA256 of the webhook body, as sha256=<hex>
+const WebhookSignatureHeader = "X-Satellite-Signature"
+
+// maxVerdictSize is the largest verdict read from a webhook
+const maxVerdictSize = 1 << 20
+
+// Webhook POSTs the request metadata to a decision service, which answers
+// with an ExecVerdict
+type Webhook struct {
+	// URL is the address of the decision service
+	URL string `yaml:"url"`
+	// Timeout is how long the decision service may take, such as 500ms
+	Timeout string `yaml:"timeout,omitempty"`
+	// FailOpen serves requests when the decision service fails or times out.
+	// Requests are denied by default
+	FailOpen bool `yaml:"fail_open,omitempty"`
+	// Secret signs the body with HMAC-SHA256 in the X-Satellite-Signature header
+	Secret string `yaml:"secret,omitempty"`
+	// CacheTTL is how long a verdict is cached for, such as 10m. Verdicts are
+	// not cached when empty
+	CacheTTL string `yaml:"cache_ttl,omitempty"`
+	// CacheKey is what verdicts are cached per: ip, subnet or ja3. The default is ip
+	CacheKey string `yaml:"cache_key,omitempty"`
+}
+
+// WebhookRequest is the document POSTed to the decision service. It has
+// the fields of the request log, plus the headers
+type WebhookRequest struct {
+	Method     string              `json:"method"`
+	Host       string              `json:"host"`
+	SNI        string              `json:"sni"`
+	RemoteAddr string              `json:"remote_addr"`
+	IP         string              `json:"ip"`
+	ReqURI     string              `json:"req_uri"`
+	JA3        string              `json:"ja3"`
+	JA4        string              `json:"ja4"`
+	JA4H       string              `json:"ja4h"`
+	H2         string              `json:"h2"`
+	UserAgent  string              `json:"user_agent"`
+	GeoIP      string              `json:"geo_ip"`
+	ASN        uint                `json:"asn"`
+	ASNOrg     string              `json:"asn_org"`
+	Headers    map[string][]string `json:"headers"`
+	Timestamp  int64               `json:"timestamp"`
+}
+
+// Validate ensures the URL and durations can be parsed
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return errors.Wrapf(err, "%s is not a valid URL", w.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New(fmt.Sprintf("%s is not an HTTP URL", w.URL))
+	}
+	for _, d := range []string{w.Timeout, w.CacheTTL} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return errors.Wrapf(err, "%s is not a valid duration", d)
+		}
+	}
+	if !validClient(w.cacheKey()) {
+		return errors.New(fmt.Sprintf("%s is not a valid webhook cache key", w.CacheKey))
+	}
+	return nil
+}
+
+func (w Webhook) timeout() time.Duration {
+	if d, err := time.ParseDuration(w.Timeout); err == nil {
+		return d
+	}
+	return DefaultWebhookTimeout
+}
+
+func (w Webhook) cacheKey() string {
+	if w.CacheKey == "" {
+		return RatePerIP
+	}
+	return strings.ToLower(w.CacheKey)
+}
+
+// Sign returns the signature of body for the X-Satellite-Signature header
+func (w Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookRequest builds the document POSTed to the decision service
+func newWebhookRequest(req *http.Request, gip geoip.DB) WebhookRequest {
+	ja3 := md5.Sum([]byte(req.JA3Fingerprint))
+	doc := WebhookRequest{
+		Method:     req.Method,
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		ReqURI:     req.RequestURI,
+		JA3:        hex.EncodeToString(ja3[:]),
+		JA4:        req.JA4Fingerprint,
+		JA4H:       req.JA4HFingerprint,
+		H2:         req.HTTP2Fingerprint,
+		UserAgent:  req.UserAgent(),
+		Headers:    req.Header,
+		Timestamp:  now().Unix(),
+	}
+	if doc.ReqURI == "" && req.URL != nil {
+		doc.ReqURI = req.URL.RequestURI()
+	}
+	if req.TLS != nil {
+		doc.SNI = req.TLS.ServerName
+	}
+
+	ip := util.GetHost(req)
+	if ip == nil {
+		return doc
+	}
+	doc.IP = ip.String()
+	if gip.HasDB() {
+		doc.GeoIP, _ = gip.CountryCode(ip)
+	}
+	if gip.HasASN() {
+		doc.ASN, doc.ASNOrg, _ = gip.ASN(ip)
+	}
+	return doc
+}
+
+// verdict POSTs the request metadata to the decision service with client and returns its verdict
+func (w Webhook) verdict(client *http.Client, req *http.Request, gip geoip.DB) (ExecVerdict, error) {
+	body, err := json.Marshal(newWebhookRequest(req, gip))
+	if err != nil {
+		return ExecVerdict{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout())
+	defer cancel()
+
+	hookReq, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return ExecVerdict{}, err
+	}
+	hookReq = hookReq.WithContext(ctx)
+	hookReq.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		hookReq.Header.Set(WebhookSignatureHeader, w.Sign(body))
+	}
+
+	resp, err := client.Do(hookReq)
+	if err != nil {
+		return ExecVerdict{}, err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ExecVerdict{}, errors.New(fmt.Sprintf("webhook returned %s", resp.Status))
+	}
+
+	var verdict ExecVerdict
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxVerdictSize)).Decode(&verdict); err != nil {
+		return ExecVerdict{}, errors.Wrap(err, "invalid verdict")
+	}
+	return verdict, nil
+}
+
+func (c *RequestConditions) webhookMatch(req *http.Request, state *State, gip geoip.DB) (bool, *ExecResponse) {
+	w := c.Webhook
+	if w.URL == "" {
+		log.Trace("No webhook")
+		return true, nil
+	}
+
+	var key string
+	ttl, err := time.ParseDuration(w.CacheTTL)
+	cache := err == nil && ttl > 0
+	// Clients without an identifier, such as requests without TLS for the
+	// ja3 key, would all share one verdict
+	client := clientIdentifier(req, w.cacheKey())
+	if cache && client == "" {
+		log.WithFields(log.Fields{
+			"cache_key": w.cacheKey(),
+		}).Debug("No client to cache the webhook verdict for")
+		cache = false
+	}
+	if cache {
+		var path string
+		if req.URL != nil {
+			path = req.URL.Path
+		}
+		key = fmt.Sprintf("%s\x00%s\x00%s\x00%s", path, w.URL, w.cacheKey(), client)
+		if verdict, ok := state.webhookVerdicts.get(key); ok {
+			log.WithFields(log.Fields{
+				"webhook": w.URL,
+				"allow":   verdict.Allow,
+				"reason":  verdict.Reason,
+			}).Debug("Cached webhook verdict")
+			return verdict.Allow, verdict.Response
+		}
+	}
+
+	verdict, err := w.verdict(state.webhookClient, req, gip)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"webhook":   w.URL,
+			"fail_open": w.FailOpen,
+			"error":     err,
+		}).Debug("Webhook failed")
+		return w.FailOpen, nil
+	}
+
+	log.WithFields(log.Fields{
+		"webhook": w.URL,
+		"allow":   verdict.Allow,
+		"reason":  verdict.Reason,
+	}).Debug("Webhook verdict")
+
+	if cache {
+		state.webhookVerdicts.set(key, verdict, ttl)
+	}
+	return verdict.Allow, verdict.Response
+}
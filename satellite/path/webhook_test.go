@@ -0,0 +1,196 @@
+package path_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/net/http"
+	"github.com/t94j0/satellite/net/http/httptest"
+	"github.com/t94j0/satellite/satellite/geoip"
+	. "github.com/t94j0/satellite/satellite/path"
+)
+
+// shouldHostWebhook runs the webhook conditions in data, where the URL is
+// formatted in with %s, against a decision service running handler. The
+// satellite HTTP server only serves TLS
+func shouldHostWebhook(t *testing.T, handler http.HandlerFunc, data string) bool {
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+	state.SetWebhookClient(server.Client())
+
+	conditions, err := NewRequestConditions([]byte(fmt.Sprintf(data, server.URL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	req := httptest.NewRequest("GET", "/payload?id=1", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("User-Agent", "curl/7.64.1")
+	return conditions.ShouldHost(req, state, geoip.DB{})
+}
+
+func verdict(allow bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"allow": %v, "reason": "test"}`, allow)
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_allow(t *testing.T) {
+	if !shouldHostWebhook(t, verdict(true), "webhook: {url: '%s'}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_deny(t *testing.T) {
+	if shouldHostWebhook(t, verdict(false), "webhook: {url: '%s'}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_request(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		var doc WebhookRequest
+		if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+			t.Error(err)
+		}
+		if req.Method != "POST" || doc.IP != "198.51.100.1" || doc.ReqURI != "/payload?id=1" ||
+			doc.UserAgent != "curl/7.64.1" || doc.Headers["User-Agent"][0] != "curl/7.64.1" {
+			t.Errorf("unexpected webhook request %+v", doc)
+		}
+		fmt.Fprint(w, `{"allow": true}`)
+	}
+	if !shouldHostWebhook(t, handler, "webhook: {url: '%s'}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_signed(t *testing.T) {
+	hook := Webhook{Secret: "hunter2"}
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		allow := req.Header.Get(WebhookSignatureHeader) == hook.Sign(body)
+		fmt.Fprintf(w, `{"allow": %v}`, allow)
+	}
+	if !shouldHostWebhook(t, handler, "webhook: {url: '%s', secret: hunter2}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_timeout_closed(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, `{"allow": true}`)
+	}
+	if shouldHostWebhook(t, handler, "webhook: {url: '%s', timeout: 50ms}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_timeout_open(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, `{"allow": false}`)
+	}
+	if !shouldHostWebhook(t, handler, "webhook: {url: '%s', timeout: 50ms, fail_open: true}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_error_status(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"allow": true}`)
+	}
+	if shouldHostWebhook(t, handler, "webhook: {url: '%s'}") {
+		t.Fail()
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_cache(t *testing.T) {
+	var calls int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, `{"allow": true}`)
+	}))
+	defer server.Close()
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+	state.SetWebhookClient(server.Client())
+
+	conditions, err := NewRequestConditions([]byte(fmt.Sprintf("webhook: {url: '%s', cache_ttl: 1m}", server.URL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, addr := range []string{"198.51.100.1:1", "198.51.100.1:2", "198.51.100.2:1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if !conditions.ShouldHost(req, state, geoip.DB{}) {
+			t.Error("request was not hosted")
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("webhook was called %d times", n)
+	}
+}
+
+func TestRequestConditions_ShouldHost_webhook_cache_no_client(t *testing.T) {
+	var calls int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, `{"allow": true}`)
+	}))
+	defer server.Close()
+	state, file, err := TemporaryDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer RemoveDB(file)
+	state.SetWebhookClient(server.Client())
+
+	conditions, err := NewRequestConditions([]byte(fmt.Sprintf("webhook: {url: '%s', cache_ttl: 1m, cache_key: ja3}", server.URL)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Requests without a JA3 fingerprint must not share a cached verdict
+	for _, addr := range []string{"198.51.100.1:1", "198.51.100.2:1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if !conditions.ShouldHost(req, state, geoip.DB{}) {
+			t.Error("request was not hosted")
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("webhook was called %d times", n)
+	}
+}
+
+func TestNewRequestConditions_webhook_bad(t *testing.T) {
+	for _, data := range []string{
+		"webhook: {url: 'ftp://example.com'}",
+		"webhook: {url: 'http://example.com', timeout: soon}",
+		"webhook: {url: 'http://example.com', cache_ttl: 1m, cache_key: asn}",
+	} {
+		if _, err := NewRequestConditions([]byte(data)); err == nil {
+			t.Errorf("%s is valid", data)
+		}
+	}
+}
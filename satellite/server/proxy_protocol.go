@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// proxyHeaderTimeout is how long a client has to send the PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the longest possible PROXY protocol v1 header
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrBadProxyHeader is returned when a connection sends an invalid PROXY protocol header
+var ErrBadProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyListener accepts connections which may start with a PROXY protocol v1 or v2 header
+type proxyListener struct {
+	net.Listener
+	proxies util.TrustedProxies
+}
+
+// ErrNoTrustedProxies is returned when the PROXY protocol is enabled without trusted proxies
+var ErrNoTrustedProxies = errors.New("proxy_protocol needs trusted_proxies")
+
+// NewProxyListener wraps a listener so that connections from trusted proxies
+// may start with a PROXY protocol v1 or v2 header. The connection's
+// RemoteAddr is then the client address from the header. Trusted proxies are
+// required, otherwise any peer could pick its own address
+func NewProxyListener(ln net.Listener, proxies util.TrustedProxies) (net.Listener, error) {
+	if !proxies.Enabled() {
+		return nil, ErrNoTrustedProxies
+	}
+	return &proxyListener{Listener: ln, proxies: proxies}, nil
+}
+
+// Accept waits for the next connection. The header is read lazily so that a
+// slow client can't hold up the accept loop
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.proxies.Contains(util.ParseHost(conn.RemoteAddr().String())) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection which may start with a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read reads from the connection after the PROXY protocol header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, or
+// the peer address when the connection didn't send one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	switch first[0] {
+	case 'P':
+		c.remote, c.err = readProxyV1(c.reader)
+	case proxyV2Signature[0]:
+		c.remote, c.err = readProxyV2(c.reader)
+	default:
+		return
+	}
+
+	if c.err != nil {
+		log.WithFields(log.Fields{
+			"peer_addr": c.Conn.RemoteAddr().String(),
+			"error":     c.err,
+		}).Debug("Rejected PROXY protocol header")
+	}
+}
+
+// readProxyV1 reads a human-readable header such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrBadProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrBadProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrBadProxyHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, ErrBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrBadProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, ErrBadProxyHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is used by the proxy itself, such as for health checks
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	if header[12]&0x0f != 1 {
+		return nil, ErrBadProxyHeader
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, ErrBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, ErrBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+
+	// Unix sockets and unspecified families carry no client IP
+	return nil, nil
+}
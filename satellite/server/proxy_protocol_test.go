@@ -0,0 +1,121 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	. "github.com/t94j0/satellite/satellite/server"
+	"github.com/t94j0/satellite/satellite/util"
+)
+
+// dialProxy sends header and a request line through a proxy listener and
+// returns the RemoteAddr and first line the server side saw
+func dialProxy(t *testing.T, trusted []string, header []byte) (string, string) {
+	proxies, err := util.NewTrustedProxies(trusted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pln, err := NewProxyListener(ln, proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(append(header, []byte("GET / HTTP/1.1\r\n")...))
+	}()
+
+	conn, err := pln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return conn.RemoteAddr().String(), ""
+	}
+	return conn.RemoteAddr().String(), line
+}
+
+func TestProxyListener_v1(t *testing.T) {
+	addr, line := dialProxy(t, []string{"127.0.0.1"}, []byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 443\r\n"))
+	if addr != "203.0.113.7:56324" || line != "GET / HTTP/1.1\r\n" {
+		t.Error(addr, line)
+	}
+}
+
+func TestProxyListener_v1_ipv6(t *testing.T) {
+	addr, line := dialProxy(t, []string{"127.0.0.1"}, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"))
+	if addr != "[2001:db8::7]:56324" || line != "GET / HTTP/1.1\r\n" {
+		t.Error(addr, line)
+	}
+}
+
+func TestProxyListener_v2(t *testing.T) {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 203, 0, 113, 7, 127, 0, 0, 1)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-4:], 56324)
+	binary.BigEndian.PutUint16(header[len(header)-2:], 443)
+
+	addr, line := dialProxy(t, []string{"127.0.0.1"}, header)
+	if addr != "203.0.113.7:56324" || line != "GET / HTTP/1.1\r\n" {
+		t.Error(addr, line)
+	}
+}
+
+func TestProxyListener_v2_local(t *testing.T) {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x20, 0x00, 0, 0)
+
+	addr, line := dialProxy(t, []string{"127.0.0.1"}, header)
+	if !util.ParseHost(addr).IsLoopback() || line != "GET / HTTP/1.1\r\n" {
+		t.Error(addr, line)
+	}
+}
+
+func TestProxyListener_no_header(t *testing.T) {
+	addr, line := dialProxy(t, []string{"127.0.0.1"}, nil)
+	if !util.ParseHost(addr).IsLoopback() || line != "GET / HTTP/1.1\r\n" {
+		t.Error(addr, line)
+	}
+}
+
+func TestProxyListener_untrusted(t *testing.T) {
+	// Headers from peers which aren't trusted proxies are passed through untouched
+	addr, line := dialProxy(t, []string{"10.0.0.0/8"}, []byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 443\r\n"))
+	if !util.ParseHost(addr).IsLoopback() || line != "PROXY TCP4 203.0.113.7 127.0.0.1 56324 443\r\n" {
+		t.Error(addr, line)
+	}
+}
+
+func TestProxyListener_bad_header(t *testing.T) {
+	if _, line := dialProxy(t, []string{"127.0.0.1"}, []byte("PROXY TCP4 nope\r\n")); line != "" {
+		t.Error(line)
+	}
+}
+
+func TestNewProxyListener_no_trusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err := NewProxyListener(ln, util.TrustedProxies{}); err != ErrNoTrustedProxies {
+		t.Error(err)
+	}
+}
@@ -22,10 +22,18 @@ type Server struct {
 	indexPath    string
 	redirectHTTP bool
 	identifier   *path.ClientID
+	// proxies are the upstream proxies trusted to forward the client address
+	proxies util.TrustedProxies
+	// proxyProtocol accepts PROXY protocol v1/v2 headers on incoming connections
+	proxyProtocol bool
 }
 
 // New creates a new Server object
-func New(paths *path.Paths, ssl SSL, nf util.NotFound, serverPath, port, serverHeader, indexPath string, redirectHTTP bool) (Server, error) {
+func New(paths *path.Paths, ssl SSL, nf util.NotFound, serverPath, port, serverHeader, indexPath string, redirectHTTP bool, proxies util.TrustedProxies, proxyProtocol bool) (Server, error) {
+	if proxyProtocol && !proxies.Enabled() {
+		return Server{}, ErrNoTrustedProxies
+	}
+
 	return Server{
 		paths:        paths,
 		serverPath:   serverPath,
@@ -37,6 +45,9 @@ func New(paths *path.Paths, ssl SSL, nf util.NotFound, serverPath, port, serverH
 
 		redirectHTTP: redirectHTTP,
 		identifier:   path.NewClientID(),
+
+		proxies:       proxies,
+		proxyProtocol: proxyProtocol,
 	}, nil
 }
 
@@ -51,7 +62,7 @@ func (s Server) Start() error {
 	rootHandler := handlers.NewRootHandler(s.paths, s.nf, s.indexPath, s.serverHeader)
 
 	mux := http.NewServeMux()
-	mux.Handle("/", http.Handler(rootHandler))
+	mux.Handle("/", handlers.NewRealIPHandler(rootHandler, s.proxies))
 
 	return s.serveHTTPS(mux)
 }
@@ -75,11 +86,21 @@ func (s Server) serveHTTPS(mux *http.ServeMux) error {
 		return err
 	}
 	defer ln.Close()
+	if s.proxyProtocol {
+		ln, err = NewProxyListener(ln, s.proxies)
+		if err != nil {
+			return err
+		}
+	}
 
 	tlsConfig, err := s.ssl.CreateTLSConfig()
 	if err != nil {
 		return err
 	}
+	// Offering h2 here and setting TLSConfig makes Serve configure HTTP/2
+	// for connections that negotiate it
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	server.TLSConfig = tlsConfig
 
 	tlsListener := tls.NewListener(ln, tlsConfig)
 	return server.Serve(tlsListener)
@@ -8,19 +8,27 @@ import (
 )
 
 type SSL struct {
-	keyPath  string
-	certPath string
+	keyPath      string
+	certPath     string
+	clientCAPath string
 }
 
-func NewSSL(keyPath, certPath string) (SSL, error) {
+// NewSSL creates the TLS configuration. When clientCAPath is set, clients
+// may send a certificate for the client_cert auth, which verifies it
+func NewSSL(keyPath, certPath, clientCAPath string) (SSL, error) {
 	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
 		return SSL{}, errors.Wrap(err, "SSL key not found")
 	}
 	if _, err := os.Stat(certPath); os.IsNotExist(err) {
 		return SSL{}, errors.Wrap(err, "SSL cert not found")
 	}
+	if clientCAPath != "" {
+		if _, err := os.Stat(clientCAPath); os.IsNotExist(err) {
+			return SSL{}, errors.Wrap(err, "SSL client CA not found")
+		}
+	}
 
-	return SSL{keyPath, certPath}, nil
+	return SSL{keyPath, certPath, clientCAPath}, nil
 }
 
 func (s SSL) CreateTLSConfig() (*tls.Config, error) {
@@ -29,5 +37,13 @@ func (s SSL) CreateTLSConfig() (*tls.Config, error) {
 		return nil, err
 	}
 	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// Clients without a certificate are still served, so that only paths
+	// with client_cert auth need one. The handshake accepts any certificate,
+	// since the CA it must chain to depends on the path
+	if s.clientCAPath != "" {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+
 	return tlsConfig, nil
 }
@@ -0,0 +1,147 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/t94j0/satellite/crypto/tls"
+	. "github.com/t94j0/satellite/satellite/server"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to dir
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "satellite test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestSSL_CreateTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satellitessl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeKeyPair(t, dir)
+
+	ssl, err := NewSSL(keyPath, certPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ssl.CreateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.ClientCAs != nil {
+		t.Fail()
+	}
+}
+
+func TestSSL_CreateTLSConfig_clientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satellitessl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeKeyPair(t, dir)
+
+	// The server certificate doubles as the client CA
+	ssl, err := NewSSL(keyPath, certPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ssl.CreateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequestClientCert || config.ClientCAs != nil {
+		t.Fail()
+	}
+}
+
+func TestSSL_CreateTLSConfig_clientCA_handshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "satellitessl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeKeyPair(t, dir)
+
+	// The server certificate doubles as the client CA
+	ssl, err := NewSSL(keyPath, certPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ssl.CreateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client certificate chains to no configured CA. The handshake still
+	// succeeds, since paths verify client certificates themselves
+	clientDir, err := ioutil.TempDir("", "satellitessl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(clientDir)
+	clientCert, err := tls.LoadX509KeyPair(writeKeyPair(t, clientDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+	clientErr := make(chan error, 1)
+	go func() { clientErr <- client.Handshake() }()
+
+	server := tls.Server(serverConn, config)
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-clientErr; err != nil {
+		t.Fatal(err)
+	}
+	if len(server.ConnectionState().PeerCertificates) != 1 {
+		t.Fail()
+	}
+}
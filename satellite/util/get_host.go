@@ -7,12 +7,20 @@ import (
 	"github.com/t94j0/satellite/net/http"
 )
 
+// GetHost returns the client IP of a request
 func GetHost(req *http.Request) net.IP {
-	inp := req.RemoteAddr
-	split := strings.Split(inp, ":")
-	filter := split[:len(split)-1]
-	full := strings.Join(filter, ":")
-	trimmedr := strings.TrimRight(full, "]")
-	trimmed := strings.TrimLeft(trimmedr, "[")
-	return net.ParseIP(trimmed)
+	return ParseHost(req.RemoteAddr)
+}
+
+// ParseHost parses the IP out of an address such as 192.0.2.1:443 or
+// [2001:db8::1]:443. Addresses without a port and IPv6 zones are accepted as well
+func ParseHost(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	if i := strings.LastIndex(host, "%"); i != -1 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
 }
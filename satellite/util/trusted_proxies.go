@@ -0,0 +1,127 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/t94j0/satellite/net/http"
+)
+
+// HeaderXForwardedFor and HeaderForwarded are the headers a trusted proxy may append the client address to
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// TrustedProxies are the upstream proxies whose forwarding header is believed.
+// Only the header the proxies append is read, so a client can't send the other
+// one through them to pick its own address
+type TrustedProxies struct {
+	ranges []*net.IPNet
+	header string
+}
+
+// NewTrustedProxies parses a list of IPs and CIDR ranges, and the header the
+// proxies append the client address to. The header defaults to X-Forwarded-For
+func NewTrustedProxies(ranges []string, header string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	switch strings.ToLower(header) {
+	case "", strings.ToLower(HeaderXForwardedFor):
+		proxies.header = HeaderXForwardedFor
+	case strings.ToLower(HeaderForwarded):
+		proxies.header = HeaderForwarded
+	default:
+		return proxies, errors.New(fmt.Sprintf("%s is not a valid trusted proxy header", header))
+	}
+
+	for _, r := range ranges {
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return proxies, errors.New(fmt.Sprintf("%s is not a valid trusted proxy", r))
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			r = fmt.Sprintf("%s/%d", r, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return proxies, errors.Wrapf(err, "%s is not a valid trusted proxy", r)
+		}
+		proxies.ranges = append(proxies.ranges, ipNet)
+	}
+	return proxies, nil
+}
+
+// Enabled is true when at least one proxy is trusted
+func (t TrustedProxies) Enabled() bool {
+	return len(t.ranges) != 0
+}
+
+// Contains checks if ip is a trusted proxy
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range t.ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP resolves the client IP of a request. The forwarding headers are
+// only used when the peer is a trusted proxy, and are walked from the nearest
+// hop backwards until an address which is not a trusted proxy is found
+func (t TrustedProxies) ClientIP(req *http.Request) net.IP {
+	ip := GetHost(req)
+	if !t.Contains(ip) {
+		return ip
+	}
+
+	hops := forwardedFor(req.Header, t.header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := ParseHost(hops[i])
+		if hop == nil {
+			// Obfuscated or unknown hops can't be followed any further
+			break
+		}
+		ip = hop
+		if !t.Contains(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the client addresses of the Forwarded or X-Forwarded-For header
+func forwardedFor(header http.Header, name string) []string {
+	var hops []string
+	if name == HeaderForwarded {
+		for _, line := range header[HeaderForwarded] {
+			for _, element := range strings.Split(line, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+						continue
+					}
+					hops = append(hops, strings.Trim(pair[4:], `"`))
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, line := range header[HeaderXForwardedFor] {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}